@@ -0,0 +1,221 @@
+package base
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jinzhu/gorm"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 审计操作类型
+type AuditAction string
+
+const (
+	AuditExec AuditAction = "exec"
+	AuditSudo AuditAction = "sudo"
+	AuditSu   AuditAction = "su"
+	AuditPut  AuditAction = "put"
+	AuditGet  AuditAction = "get"
+)
+
+// 一次远程操作的审计记录
+type AuditEvent struct {
+	Host string `json:"host"`
+	Addr string `json:"addr"`
+	// 登录用户
+	User string `json:"user"`
+	// 提权后的目标用户
+	RunAs  string      `json:"runAs,omitempty"`
+	Action AuditAction `json:"action"`
+	// 执行的命令，传输时为 本地路径 -> 远程路径，密码等敏感内容已替换为 ******
+	Command   string    `json:"command"`
+	StartTime time.Time `json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	// 连接失败或被取消时为 -1
+	ExitCode int `json:"exitCode"`
+	// 命令为输出的字节数，传输为文件内容的字节数
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// 审计钩子，同步调用，返回的错误只记录日志不影响操作结果
+type AuditHook interface {
+	Audit(event *AuditEvent) error
+}
+
+type AuditHookFunc func(event *AuditEvent) error
+
+func (f AuditHookFunc) Audit(event *AuditEvent) error {
+	return f(event)
+}
+
+var (
+	auditLock  sync.RWMutex
+	auditHooks []AuditHook
+)
+
+func RegisterAuditHook(hook AuditHook) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditHooks = append(auditHooks, hook)
+}
+
+func ClearAuditHooks() {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	auditHooks = nil
+}
+
+// 命令中 password=xxx、--password xxx 等形式的参数值
+var auditSecretRegexp = regexp.MustCompile(`(?i)((?:--?(?:password|passwd|secret|token|api[_-]?key)\s+)|(?:password|passwd|secret|token|api[_-]?key)\s*[=:]\s*)('[^']*'|"[^"]*"|\S+)`)
+
+// 去掉主机密码、私钥密码和额外指定的敏感内容
+func redactSecrets(s string, h *Host, secrets ...string) string {
+	s = auditSecretRegexp.ReplaceAllString(s, "${1}******")
+	for _, secret := range append([]string{h.Password, h.Passphrase}, secrets...) {
+		if secret != "" {
+			s = strings.Replace(s, secret, "******", -1)
+		}
+	}
+	return s
+}
+
+func emitAudit(h *Host, event *AuditEvent, err error, secrets ...string) {
+	auditLock.RLock()
+	hooks := auditHooks
+	auditLock.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	event.Host = hostName(h)
+	event.Addr = hostAddr(h)
+	event.User = h.User
+	event.Command = redactSecrets(event.Command, h, secrets...)
+	if event.EndTime.IsZero() {
+		event.EndTime = time.Now()
+	}
+	if err != nil {
+		event.Error = redactSecrets(err.Error(), h, secrets...)
+	}
+	for _, hook := range hooks {
+		if err := hook.Audit(event); err != nil {
+			log.Warnf("audit %s on %s failed: %v", event.Action, event.Host, err)
+		}
+	}
+}
+
+// 命令执行的审计，result 为空说明命令没有开始执行
+func auditCommand(h *Host, action AuditAction, runAs string, command string, start time.Time, result *CommandResult, bytes int64, err error, secrets ...string) {
+	event := &AuditEvent{
+		Action:    action,
+		RunAs:     runAs,
+		Command:   command,
+		StartTime: start,
+		ExitCode:  -1,
+		Bytes:     bytes,
+	}
+	if result != nil {
+		event.ExitCode = result.ExitCode
+	}
+	emitAudit(h, event, err, secrets...)
+}
+
+// 统计 session 输出的字节数，stdout 和 stderr 由不同协程写入
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&c.n, int64(len(b)))
+	return len(b), nil
+}
+
+func (c *byteCounter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// 以 JSON Lines 格式追加写入文件
+type JSONAuditSink struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewJSONAuditSink(path string) (*JSONAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONAuditSink{file: file}, nil
+}
+
+func (s *JSONAuditSink) Audit(event *AuditEvent) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// 命令中的 < > & 保持原样
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.file.Write(buf.Bytes())
+	return err
+}
+
+func (s *JSONAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// 审计记录表，使用 dbHelper.SqliteDB 时表名为 t_audit_logs
+type AuditLog struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	Host      string    `gorm:"index" json:"host"`
+	Addr      string    `json:"addr"`
+	User      string    `json:"user"`
+	RunAs     string    `json:"runAs"`
+	Action    string    `gorm:"index" json:"action"`
+	Command   string    `gorm:"type:text" json:"command"`
+	StartTime time.Time `gorm:"index" json:"startTime"`
+	EndTime   time.Time `json:"endTime"`
+	ExitCode  int       `json:"exitCode"`
+	Bytes     int64     `json:"bytes"`
+	Error     string    `gorm:"type:text" json:"error"`
+}
+
+// 写入数据库的审计钩子
+type DBAuditSink struct {
+	db *gorm.DB
+}
+
+// db 一般为 dbHelper.SqliteDB 的 DB，会自动创建 AuditLog 表
+func NewDBAuditSink(db *gorm.DB) (*DBAuditSink, error) {
+	if err := db.AutoMigrate(&AuditLog{}).Error; err != nil {
+		return nil, err
+	}
+	return &DBAuditSink{db: db}, nil
+}
+
+func (s *DBAuditSink) Audit(event *AuditEvent) error {
+	return s.db.Create(&AuditLog{
+		Host:      event.Host,
+		Addr:      event.Addr,
+		User:      event.User,
+		RunAs:     event.RunAs,
+		Action:    string(event.Action),
+		Command:   event.Command,
+		StartTime: event.StartTime,
+		EndTime:   event.EndTime,
+		ExitCode:  event.ExitCode,
+		Bytes:     event.Bytes,
+		Error:     event.Error,
+	}).Error
+}
@@ -0,0 +1,152 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+)
+
+func authMethods(h *Host) ([]ssh.AuthMethod, error) {
+	switch h.AuthType {
+	case PasswordAuth:
+		return []ssh.AuthMethod{ssh.Password(h.Password)}, nil
+	case "", KeyFileAuth, PassphraseKeyFileAuth:
+		signer, err := keyFileSigner(h.KeyFile, h.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	case PrivateKeyAuth:
+		signer, err := parsePrivateKey([]byte(h.PrivateKey), h.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key of %s: %w", hostName(h), err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	case AgentAuth:
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agentSigners)}, nil
+	case KeyboardInteractiveAuth:
+		// PAM 主机一般只接受 keyboard-interactive，所有提问都用密码应答
+		return []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					answers[i] = h.Password
+				}
+				return answers, nil
+			}),
+			ssh.Password(h.Password),
+		}, nil
+	case CertificateAuth:
+		signer, err := certificateSigner(h)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth type: %s", h.AuthType)
+	}
+}
+
+func keyFileSigner(keyFile string, passphrase string) (ssh.Signer, error) {
+	path, err := homedir.Expand(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh key file read failed: %w", err)
+	}
+	signer, err := parsePrivateKey(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("ssh key file %s: %w", keyFile, err)
+	}
+	return signer, nil
+}
+
+func parsePrivateKey(key []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("private key is encrypted, passphrase is required")
+	}
+	return signer, err
+}
+
+// OpenSSH 用户证书，证书为 CertFile，私钥为 PrivateKey 或 KeyFile
+func certificateSigner(h *Host) (ssh.Signer, error) {
+	var (
+		signer ssh.Signer
+		err    error
+	)
+	if h.PrivateKey != "" {
+		signer, err = parsePrivateKey([]byte(h.PrivateKey), h.Passphrase)
+	} else {
+		signer, err = keyFileSigner(h.KeyFile, h.Passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := homedir.Expand(h.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh certificate read failed: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("ssh certificate %s: %w", h.CertFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("ssh certificate %s: not a certificate", h.CertFile)
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// 进程内共用一个 ssh-agent 连接，连接失效时重新建立
+var agentLock sync.Mutex
+var agentConn net.Conn
+var agentClient agent.ExtendedAgent
+
+func agentSigners() ([]ssh.Signer, error) {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if agentConn == nil {
+			socket := os.Getenv("SSH_AUTH_SOCK")
+			if socket == "" {
+				return nil, errors.New("SSH_AUTH_SOCK is not set")
+			}
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, fmt.Errorf("connect ssh-agent: %w", err)
+			}
+			agentConn = conn
+			agentClient = agent.NewClient(conn)
+		}
+		signers, err := agentClient.Signers()
+		if err == nil {
+			return signers, nil
+		}
+		agentConn.Close()
+		agentConn = nil
+		agentClient = nil
+		if i > 0 {
+			return nil, fmt.Errorf("ssh-agent: %w", err)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+package base
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 环境变量的传递方式
+type EnvMode string
+
+const (
+	// 先尝试 Setenv，服务端拒绝时改为命令前缀
+	EnvAuto EnvMode = ""
+	// 只使用 Setenv，需要服务端 AcceptEnv 允许
+	EnvSetenv EnvMode = "setenv"
+	// 在命令前 export 变量
+	EnvPrefix EnvMode = "prefix"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// 记录拒绝 Setenv 的主机，之后直接使用命令前缀
+var envRefused sync.Map
+
+// 设置 session 环境变量，服务端拒绝 Setenv 时返回需要加在命令前的 export 前缀
+func applyEnv(session *ssh.Session, h *Host, envs []EnvMap) (string, error) {
+	vars, err := flattenEnv(envs)
+	if err != nil || len(vars) == 0 {
+		return "", err
+	}
+
+	mode := h.EnvMode
+	if mode == EnvAuto {
+		if _, refused := envRefused.Load(poolKey(h)); refused {
+			mode = EnvPrefix
+		}
+	}
+	if mode == EnvPrefix {
+		return envPrefix(h.Platform, vars), nil
+	}
+
+	for _, kv := range vars {
+		err = session.Setenv(kv[0], kv[1])
+		if err == nil {
+			continue
+		}
+		if mode == EnvSetenv {
+			return "", err
+		}
+		log.Debugf("%s refused setenv %s, fallback to export: %v", hostName(h), kv[0], err)
+		envRefused.Store(poolKey(h), true)
+		return envPrefix(h.Platform, vars), nil
+	}
+	return "", nil
+}
+
+// 合并多个 EnvMap，后面的覆盖前面的，按变量名排序保证命令稳定
+func flattenEnv(envs []EnvMap) ([][2]string, error) {
+	merged := make(map[string]string)
+	for _, env := range envs {
+		for k, v := range env {
+			if !envNameRegexp.MatchString(k) {
+				return nil, fmt.Errorf("invalid environment variable name: %q", k)
+			}
+			merged[k] = v
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for k := range merged {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	vars := make([][2]string, 0, len(names))
+	for _, k := range names {
+		vars = append(vars, [2]string{k, merged[k]})
+	}
+	return vars, nil
+}
+
+// Linux、AIX、HP-UX 的默认 shell 支持 export K=V，
+// SunOS 的 /bin/sh 为 Bourne shell，平台未知时同样使用兼容写法 K=V; export K
+func envPrefix(platform Platform, vars [][2]string) string {
+	var b strings.Builder
+	for _, kv := range vars {
+		switch platform {
+		case LinuxPlatform, AIXPlatform, HPPlatform:
+			b.WriteString("export " + kv[0] + "=" + shellQuote(kv[1]) + "; ")
+		default:
+			b.WriteString(kv[0] + "=" + shellQuote(kv[1]) + "; export " + kv[0] + "; ")
+		}
+	}
+	return b.String()
+}
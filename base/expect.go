@@ -0,0 +1,267 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const defaultTerm = "xterm"
+
+var ErrExpectTimeout = errors.New("expect: timeout")
+
+func requestPty(session *ssh.Session, term string, width int, height int) error {
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	return session.RequestPty(term, height, width, modes)
+}
+
+// 交互式会话选项
+type ShellOptions struct {
+	// 为空时启动登录 shell
+	Command string
+	// 终端类型，为空时为 xterm
+	Term   string
+	Width  int
+	Height int
+	Envs   []EnvMap
+}
+
+// 基于 pty 的交互式会话，用于只能交互执行的命令(修改密码、厂商安装程序等)
+type ShellSession struct {
+	session    *ssh.Session
+	release    func()
+	stdin      io.WriteCloser
+	mutex      sync.Mutex
+	buf        []byte
+	transcript bytes.Buffer
+	notify     chan struct{}
+	eof        bool
+	readErr    error
+	done       chan struct{}
+	waitErr    error
+	closeOnce  sync.Once
+}
+
+func NewShellSession(h *Host, cfg ssh.Config, opts *ShellOptions) (*ShellSession, error) {
+	return NewShellSessionContext(context.Background(), h, cfg, opts)
+}
+
+// ctx 只作用于建立连接和会话
+func NewShellSessionContext(ctx context.Context, h *Host, cfg ssh.Config, opts *ShellOptions) (*ShellSession, error) {
+	if opts == nil {
+		opts = &ShellOptions{}
+	}
+	client, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newShellSession(client, h, opts)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	s.release = release
+	return s, nil
+}
+
+func newShellSession(client *ssh.Client, h *Host, opts *ShellOptions) (*ShellSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	// 设置环境变量
+	prefix, err := applyEnv(session, h, opts.Envs)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	term, width, height := opts.Term, opts.Width, opts.Height
+	if term == "" {
+		term = defaultTerm
+	}
+	if width <= 0 {
+		width = 200
+	}
+	if height <= 0 {
+		height = 40
+	}
+	if err := requestPty(session, term, width, height); err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if opts.Command == "" {
+		err = session.Shell()
+		if err == nil && prefix != "" {
+			// 交互式 shell 无法加命令前缀，作为第一行输入
+			_, err = io.WriteString(stdin, prefix+"\n")
+		}
+	} else {
+		err = session.Start(prefix + opts.Command)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	s := &ShellSession{
+		session: session,
+		release: func() {},
+		stdin:   stdin,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go s.read(stdout)
+	go func() {
+		s.waitErr = session.Wait()
+		close(s.done)
+	}()
+	return s, nil
+}
+
+func (s *ShellSession) read(r io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		s.mutex.Lock()
+		if n > 0 {
+			s.buf = append(s.buf, buf[:n]...)
+			s.transcript.Write(buf[:n])
+		}
+		if err != nil {
+			s.eof = true
+			if err != io.EOF {
+				s.readErr = err
+			}
+		}
+		s.mutex.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *ShellSession) Send(input string) error {
+	s.mutex.Lock()
+	s.transcript.WriteString(input)
+	s.mutex.Unlock()
+	_, err := io.WriteString(s.stdin, input)
+	return err
+}
+
+func (s *ShellSession) SendLine(line string) error {
+	return s.Send(line + "\n")
+}
+
+// 发送密码等敏感内容，记录中用 ****** 代替
+func (s *ShellSession) SendSecret(secret string) error {
+	s.mutex.Lock()
+	s.transcript.WriteString("******\n")
+	s.mutex.Unlock()
+	_, err := io.WriteString(s.stdin, secret+"\n")
+	return err
+}
+
+// 等待输出匹配 re，返回匹配结束位置之前的全部输出和子匹配，
+// timeout 内没有匹配时返回 ErrExpectTimeout，会话结束仍没有匹配时返回 io.EOF
+func (s *ShellSession) Expect(re *regexp.Regexp, timeout time.Duration) (string, []string, error) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		s.mutex.Lock()
+		if loc := re.FindSubmatchIndex(s.buf); loc != nil {
+			output := string(s.buf[:loc[1]])
+			var groups []string
+			for i := 0; i+1 < len(loc); i += 2 {
+				if loc[i] < 0 {
+					groups = append(groups, "")
+					continue
+				}
+				groups = append(groups, string(s.buf[loc[i]:loc[i+1]]))
+			}
+			s.buf = s.buf[loc[1]:]
+			s.mutex.Unlock()
+			return output, groups, nil
+		}
+		eof, readErr := s.eof, s.readErr
+		s.mutex.Unlock()
+
+		if eof {
+			if readErr != nil {
+				return "", nil, readErr
+			}
+			return "", nil, io.EOF
+		}
+		select {
+		case <-s.notify:
+		case <-deadline:
+			return "", nil, ErrExpectTimeout
+		}
+	}
+}
+
+func (s *ShellSession) ExpectString(str string, timeout time.Duration) (string, error) {
+	output, _, err := s.Expect(regexp.MustCompile(regexp.QuoteMeta(str)), timeout)
+	return output, err
+}
+
+// 调整终端窗口大小
+func (s *ShellSession) Resize(width int, height int) error {
+	return s.session.WindowChange(height, width)
+}
+
+// 会话的完整记录，包括输出和发送的内容
+func (s *ShellSession) Transcript() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.transcript.String()
+}
+
+// 关闭输入并等待远程命令结束
+func (s *ShellSession) Wait() error {
+	s.stdin.Close()
+	<-s.done
+	return s.waitErr
+}
+
+// 结束会话并释放连接，Wait 之后也需要调用
+func (s *ShellSession) Close() error {
+	err := s.session.Close()
+	<-s.done
+	s.closeOnce.Do(s.release)
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
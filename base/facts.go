@@ -0,0 +1,303 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 主机基础信息
+type Facts struct {
+	Hostname    string             `json:"hostname"`
+	Platform    Platform           `json:"platform"`
+	OS          string             `json:"os"`
+	OSVersion   string             `json:"osVersion"`
+	Kernel      string             `json:"kernel"`
+	Arch        string             `json:"arch"`
+	CPUCount    int                `json:"cpuCount"`
+	Memory      MemoryInfo         `json:"memory"`
+	FileSystems []FileSystemUsage  `json:"fileSystems"`
+	Interfaces  []NetworkInterface `json:"interfaces"`
+}
+
+type NetworkInterface struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+const factSectionPrefix = "==== "
+
+// 各平台的采集命令，按段输出，段名为 factSectionPrefix 开头的行
+var factCommands = map[Platform][][2]string{
+	LinuxPlatform: {
+		{"hostname", "uname -n"},
+		{"kernel", "uname -r"},
+		{"arch", "uname -m"},
+		{"os", "cat /etc/os-release 2>/dev/null || cat /etc/redhat-release /etc/SuSE-release 2>/dev/null"},
+		{"cpu", "getconf _NPROCESSORS_ONLN 2>/dev/null || grep -c ^processor /proc/cpuinfo"},
+		{"net", "ip -o addr show 2>/dev/null || /sbin/ifconfig -a"},
+	},
+	AIXPlatform: {
+		{"hostname", "uname -n"},
+		{"kernel", "uname -v; uname -r"},
+		{"arch", "uname -p"},
+		{"osversion", "oslevel -s"},
+		{"cpu", "bindprocessor -q"},
+		{"net", "ifconfig -a"},
+	},
+	SunOsPlatform: {
+		{"hostname", "uname -n"},
+		{"kernel", "uname -v"},
+		{"arch", "uname -p"},
+		{"os", "head -1 /etc/release"},
+		{"osversion", "uname -r"},
+		{"cpu", "/usr/sbin/psrinfo | wc -l"},
+		{"net", "/sbin/ifconfig -a"},
+	},
+	HPPlatform: {
+		{"hostname", "uname -n"},
+		{"kernel", "uname -r"},
+		{"arch", "uname -m"},
+		{"osversion", "uname -r"},
+		{"cpu", "/usr/sbin/ioscan -kFC processor | wc -l"},
+		{"net", "netstat -in"},
+	},
+}
+
+func GatherFacts(h *Host, cfg ssh.Config) (*Facts, error) {
+	return GatherFactsContext(context.Background(), h, cfg)
+}
+
+// 只建立一次连接，Host.Platform 为空时先识别平台
+func GatherFactsContext(ctx context.Context, h *Host, cfg ssh.Config) (*Facts, error) {
+	conn, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	platform := h.Platform
+	if platform == "" {
+		result, err := runCommand(ctx, conn, h, "uname -s")
+		if err != nil {
+			return nil, err
+		}
+		platform, err = parsePlatform(result.Stdout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	adapter, err := NewPlatformAdapter(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	var script []string
+	addSection := func(name string, cmd string) {
+		script = append(script, "echo '"+factSectionPrefix+name+"'", "("+cmd+") 2>/dev/null")
+	}
+	for _, c := range factCommands[platform] {
+		addSection(c[0], c[1])
+	}
+	addSection("memory", adapter.MemoryCmd())
+	addSection("disk", adapter.DiskUsageCmd(""))
+
+	// 部分命令失败时退出码非 0，仍然解析已有的输出
+	result, err := runCommand(ctx, conn, h, strings.Join(script, "; "))
+	var exitErr *ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	sections := splitFactSections(result.Stdout)
+
+	facts := &Facts{
+		Platform: platform,
+		Hostname: firstLine(sections["hostname"]),
+		Kernel:   firstLine(sections["kernel"]),
+		Arch:     firstLine(sections["arch"]),
+	}
+	if platform == AIXPlatform {
+		// uname -v 和 uname -r 分别为主次版本号
+		facts.Kernel = strings.Join(strings.Fields(sections["kernel"]), ".")
+	}
+	facts.OS, facts.OSVersion = parseOSRelease(platform, sections["os"], sections["osversion"])
+	facts.CPUCount = parseCPUCount(platform, sections["cpu"])
+	if memory, err := adapter.ParseMemory(sections["memory"]); err == nil {
+		facts.Memory = *memory
+	}
+	facts.FileSystems, _ = adapter.ParseDiskUsage(sections["disk"])
+	if platform == HPPlatform {
+		facts.Interfaces = parseNetstatInterfaces(sections["net"])
+	} else {
+		facts.Interfaces = parseInterfaces(sections["net"])
+	}
+	return facts, nil
+}
+
+func splitFactSections(output string) map[string]string {
+	sections := make(map[string]string)
+	var (
+		name  string
+		lines []string
+	)
+	flush := func() {
+		if name != "" {
+			sections[name] = strings.Join(lines, "\n")
+		}
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, factSectionPrefix) {
+			flush()
+			name = strings.TrimSpace(strings.TrimPrefix(line, factSectionPrefix))
+			lines = nil
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	return sections
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+var releaseVersionRegexp = regexp.MustCompile(`[0-9]+(\.[0-9]+)*`)
+
+func parseOSRelease(platform Platform, os string, version string) (string, string) {
+	switch platform {
+	case LinuxPlatform:
+		values := make(map[string]string)
+		for _, line := range strings.Split(os, "\n") {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) == 2 {
+				values[kv[0]] = strings.Trim(kv[1], `"'`)
+			}
+		}
+		if values["NAME"] != "" {
+			return values["NAME"], values["VERSION_ID"]
+		}
+		// redhat-release: CentOS release 6.10 (Final)
+		line := firstLine(os)
+		return line, releaseVersionRegexp.FindString(line)
+	case SunOsPlatform:
+		return firstLine(os), firstLine(version)
+	default:
+		return string(platform), firstLine(version)
+	}
+}
+
+func parseCPUCount(platform Platform, output string) int {
+	if platform == AIXPlatform {
+		// The available processors are:  0 1 2 3
+		count := 0
+		if i := strings.IndexByte(output, ':'); i >= 0 {
+			for _, field := range strings.Fields(output[i+1:]) {
+				if _, err := strconv.Atoi(field); err == nil {
+					count++
+				}
+			}
+		}
+		return count
+	}
+	count, _ := strconv.Atoi(firstLine(output))
+	return count
+}
+
+// 解析 ip -o addr 或 ifconfig -a 的输出
+func parseInterfaces(output string) []NetworkInterface {
+	var (
+		interfaces []NetworkInterface
+		index      = make(map[string]int)
+	)
+	add := func(name string, addr string) {
+		i, ok := index[name]
+		if !ok {
+			i = len(interfaces)
+			index[name] = i
+			interfaces = append(interfaces, NetworkInterface{Name: name})
+		}
+		if addr != "" {
+			interfaces[i].Addresses = append(interfaces[i].Addresses, addr)
+		}
+	}
+
+	var current string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// ip -o addr: 2: eth0    inet 10.0.0.5/24 brd ...
+		if len(fields) > 3 && strings.HasSuffix(fields[0], ":") && (fields[2] == "inet" || fields[2] == "inet6") {
+			add(strings.TrimSuffix(fields[1], ":"), strings.SplitN(fields[3], "/", 2)[0])
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			// en0: flags=... 或 eth0      Link encap:Ethernet
+			current = strings.TrimSuffix(fields[0], ":")
+			add(current, "")
+			continue
+		}
+		if current == "" || len(fields) < 2 || (fields[0] != "inet" && fields[0] != "inet6") {
+			continue
+		}
+		addr := strings.TrimPrefix(fields[1], "addr:")
+		if addr == "" && len(fields) > 2 {
+			// inet6 addr: fe80::1/64
+			addr = fields[2]
+		}
+		add(current, strings.SplitN(addr, "/", 2)[0])
+	}
+	return interfaces
+}
+
+// HP-UX netstat -in，IPv4 表为 Name Mtu Network Address Ipkts ...，
+// 之后可能还有 IPv6 表 Name Mtu Address/Prefix Ipkts Opkts，每张表都有表头
+func parseNetstatInterfaces(output string) []NetworkInterface {
+	var (
+		interfaces []NetworkInterface
+		index      = make(map[string]int)
+		column     = 3
+	)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "Name" {
+			column = 3
+			if len(fields) > 2 && strings.HasPrefix(fields[2], "Address") {
+				column = 2
+			}
+			continue
+		}
+		if len(fields) <= column {
+			continue
+		}
+		// 停用的接口名后带 *
+		name := strings.TrimSuffix(fields[0], "*")
+		i, ok := index[name]
+		if !ok {
+			i = len(interfaces)
+			index[name] = i
+			interfaces = append(interfaces, NetworkInterface{Name: name})
+		}
+		// 没有配置地址时为 none
+		if addr := strings.SplitN(fields[column], "/", 2)[0]; addr != "none" {
+			interfaces[i].Addresses = append(interfaces[i].Addresses, addr)
+		}
+	}
+	return interfaces
+}
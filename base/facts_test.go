@@ -0,0 +1,181 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFactSections(t *testing.T) {
+	output := "==== hostname\nweb01\n==== kernel\n==== net\n1: lo    inet 127.0.0.1/8 scope host lo\n"
+	want := map[string]string{
+		"hostname": "web01",
+		"kernel":   "",
+		"net":      "1: lo    inet 127.0.0.1/8 scope host lo\n",
+	}
+	if got := splitFactSections(output); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseInterfaces(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		output string
+		want   []NetworkInterface
+	}{
+		{
+			name: "ip -o addr",
+			output: `1: lo    inet 127.0.0.1/8 scope host lo\       valid_lft forever preferred_lft forever
+1: lo    inet6 ::1/128 scope host \       valid_lft forever preferred_lft forever
+2: eth0    inet 10.0.0.5/24 brd 10.0.0.255 scope global eth0\       valid_lft forever preferred_lft forever
+2: eth0    inet6 fe80::5054:ff:fe12:3456/64 scope link \       valid_lft forever preferred_lft forever
+`,
+			want: []NetworkInterface{
+				{Name: "lo", Addresses: []string{"127.0.0.1", "::1"}},
+				{Name: "eth0", Addresses: []string{"10.0.0.5", "fe80::5054:ff:fe12:3456"}},
+			},
+		},
+		{
+			name: "linux ifconfig",
+			output: `eth0      Link encap:Ethernet  HWaddr 52:54:00:12:34:56
+          inet addr:10.0.0.5  Bcast:10.0.0.255  Mask:255.255.255.0
+          inet6 addr: fe80::5054:ff:fe12:3456/64 Scope:Link
+          UP BROADCAST RUNNING MULTICAST  MTU:1500  Metric:1
+
+lo        Link encap:Local Loopback
+          inet addr:127.0.0.1  Mask:255.0.0.0
+          UP LOOPBACK RUNNING  MTU:65536  Metric:1
+`,
+			want: []NetworkInterface{
+				{Name: "eth0", Addresses: []string{"10.0.0.5", "fe80::5054:ff:fe12:3456"}},
+				{Name: "lo", Addresses: []string{"127.0.0.1"}},
+			},
+		},
+		{
+			name: "linux ifconfig net-tools 2",
+			output: `eth0: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 1500
+        inet 10.0.0.5  netmask 255.255.255.0  broadcast 10.0.0.255
+        inet6 fe80::5054:ff:fe12:3456  prefixlen 64  scopeid 0x20<link>
+        ether 52:54:00:12:34:56  txqueuelen 1000  (Ethernet)
+`,
+			want: []NetworkInterface{
+				{Name: "eth0", Addresses: []string{"10.0.0.5", "fe80::5054:ff:fe12:3456"}},
+			},
+		},
+		{
+			name: "aix ifconfig",
+			output: `en0: flags=1e084863,480<UP,BROADCAST,NOTRAILERS,RUNNING,SIMPLEX,MULTICAST,GROUPRT,64BIT,CHECKSUM_OFFLOAD(ACTIVE),CHAIN>
+	inet 192.168.1.10 netmask 0xffffff00 broadcast 192.168.1.255
+	 tcp_sendspace 262144 tcp_recvspace 262144 rfc1323 1
+lo0: flags=e08084b,c0<UP,BROADCAST,LOOPBACK,RUNNING,SIMPLEX,MULTICAST,GROUPRT,64BIT,LARGESEND,CHAIN>
+	inet 127.0.0.1 netmask 0xff000000 broadcast 127.255.255.255
+	inet6 ::1%1/0
+	 tcp_sendspace 131072 tcp_recvspace 131072 rfc1323 1
+`,
+			want: []NetworkInterface{
+				{Name: "en0", Addresses: []string{"192.168.1.10"}},
+				{Name: "lo0", Addresses: []string{"127.0.0.1", "::1%1"}},
+			},
+		},
+		{
+			name: "solaris ifconfig",
+			output: `lo0: flags=2001000849<UP,LOOPBACK,RUNNING,MULTICAST,IPv4,VIRTUAL> mtu 8232 index 1
+	inet 127.0.0.1 netmask ff000000 
+net0: flags=100001000843<UP,BROADCAST,RUNNING,MULTICAST,IPv4,PHYSRUNNING> mtu 1500 index 2
+	inet 192.168.1.20 netmask ffffff00 broadcast 192.168.1.255
+	ether 0:14:4f:fa:5b:2 
+lo0: flags=2002000849<UP,LOOPBACK,RUNNING,MULTICAST,IPv6,VIRTUAL> mtu 8252 index 1
+	inet6 ::1/128 
+net0: flags=120002004841<UP,RUNNING,MULTICAST,DHCP,IPv6,PHYSRUNNING> mtu 1500 index 2
+	inet6 fe80::214:4fff:fefa:5b02/10 
+`,
+			want: []NetworkInterface{
+				{Name: "lo0", Addresses: []string{"127.0.0.1", "::1"}},
+				{Name: "net0", Addresses: []string{"192.168.1.20", "fe80::214:4fff:fefa:5b02"}},
+			},
+		},
+	} {
+		if got := parseInterfaces(c.output); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseNetstatInterfaces(t *testing.T) {
+	output := `Name      Mtu  Network         Address         Ipkts              Ierrs Opkts              Oerrs Coll
+lan0      1500 192.168.1.0     192.168.1.30    18442061           0     9863513            0     0
+lo0       32808 127.0.0.0      127.0.0.1       1215934            0     1215934            0     0
+lan1*     1500 none            none            0                  0     0                  0     0
+
+Name      Mtu  Address/Prefix                    Ipkts              Opkts
+lan0      1500 fe80::21e:bff:fe5a:1234/64        1034               22
+lo0       32808 ::1/128                          452                452
+`
+	want := []NetworkInterface{
+		{Name: "lan0", Addresses: []string{"192.168.1.30", "fe80::21e:bff:fe5a:1234"}},
+		{Name: "lo0", Addresses: []string{"127.0.0.1", "::1"}},
+		{Name: "lan1"},
+	}
+	if got := parseNetstatInterfaces(output); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	for _, c := range []struct {
+		platform    Platform
+		os, version string
+		wantOS      string
+		wantVersion string
+	}{
+		{
+			platform: LinuxPlatform,
+			os: `NAME="Ubuntu"
+VERSION="22.04.3 LTS (Jammy Jellyfish)"
+ID=ubuntu
+VERSION_ID="22.04"
+`,
+			wantOS:      "Ubuntu",
+			wantVersion: "22.04",
+		},
+		{
+			platform:    LinuxPlatform,
+			os:          "CentOS release 6.10 (Final)\n",
+			wantOS:      "CentOS release 6.10 (Final)",
+			wantVersion: "6.10",
+		},
+		{
+			platform:    SunOsPlatform,
+			os:          "                             Oracle Solaris 11.4 SPARC\n",
+			version:     "5.11\n",
+			wantOS:      "Oracle Solaris 11.4 SPARC",
+			wantVersion: "5.11",
+		},
+		{platform: AIXPlatform, version: "7200-05-03-2148\n", wantOS: "AIX", wantVersion: "7200-05-03-2148"},
+		{platform: HPPlatform, version: "B.11.31\n", wantOS: "HP-UX", wantVersion: "B.11.31"},
+	} {
+		os, version := parseOSRelease(c.platform, c.os, c.version)
+		if os != c.wantOS || version != c.wantVersion {
+			t.Errorf("%s: got %q %q, want %q %q", c.platform, os, version, c.wantOS, c.wantVersion)
+		}
+	}
+}
+
+func TestParseCPUCount(t *testing.T) {
+	for _, c := range []struct {
+		platform Platform
+		output   string
+		want     int
+	}{
+		{LinuxPlatform, "8\n", 8},
+		{AIXPlatform, "The available processors are:  0 1 2 3\n", 4},
+		{AIXPlatform, "bindprocessor: not found\n", 0},
+		{SunOsPlatform, "      16\n", 16},
+		{HPPlatform, "2\n", 2},
+		{LinuxPlatform, "", 0},
+	} {
+		if got := parseCPUCount(c.platform, c.output); got != c.want {
+			t.Errorf("%s %q: got %d, want %d", c.platform, c.output, got, c.want)
+		}
+	}
+}
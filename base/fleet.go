@@ -0,0 +1,195 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultFleetConcurrency = 10
+
+type HostStatus string
+
+const (
+	HostSucceeded HostStatus = "succeeded"
+	// 命令执行失败或超时
+	HostFailed HostStatus = "failed"
+	// 无法建立连接
+	HostUnreachable HostStatus = "unreachable"
+	// FailFast 模式下因其它主机失败而未执行
+	HostSkipped HostStatus = "skipped"
+	// 执行中因其它主机失败或整体被取消而中断
+	HostCancelled HostStatus = "cancelled"
+)
+
+// 批量执行选项
+type FleetOptions struct {
+	// 最大并发数，为 0 时默认 10
+	Concurrency int
+	// 单台主机的超时时间(包含建立连接)，为 0 时不限制
+	Timeout time.Duration
+	// 任意一台主机失败后取消其余主机
+	FailFast bool
+	// 使用 sudo 执行
+	Sudo bool
+	Envs []EnvMap
+}
+
+// 单台主机的执行结果
+type FleetResult struct {
+	Host   *Host          `json:"host"`
+	Status HostStatus     `json:"status"`
+	Result *CommandResult `json:"result"`
+	Err    error          `json:"-"`
+}
+
+// 批量执行汇总，Results 与传入的主机顺序一致，其余字段为主机名
+type FleetSummary struct {
+	Results     []*FleetResult `json:"results"`
+	Succeeded   []string       `json:"succeeded"`
+	Failed      []string       `json:"failed"`
+	Unreachable []string       `json:"unreachable"`
+	Skipped     []string       `json:"skipped"`
+	Cancelled   []string       `json:"cancelled"`
+}
+
+// 全部主机都执行成功时返回 nil
+func (s *FleetSummary) Err() error {
+	if len(s.Failed) == 0 && len(s.Unreachable) == 0 && len(s.Skipped) == 0 && len(s.Cancelled) == 0 {
+		return nil
+	}
+	return fmt.Errorf("fleet execution: %d succeeded, %d failed [%s], %d unreachable [%s], %d skipped, %d cancelled",
+		len(s.Succeeded), len(s.Failed), strings.Join(s.Failed, ","),
+		len(s.Unreachable), strings.Join(s.Unreachable, ","), len(s.Skipped), len(s.Cancelled))
+}
+
+// 在多台主机上并发执行同一条命令
+func RunFleet(ctx context.Context, hosts []*Host, cfg ssh.Config, cmd string, opts *FleetOptions) *FleetSummary {
+	if opts == nil {
+		opts = &FleetOptions{}
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultFleetConcurrency
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*FleetResult, len(hosts))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, h := range hosts {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			results[i] = &FleetResult{Host: h, Status: HostSkipped, Err: ctx.Err()}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, h *Host) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			r := runFleetHost(ctx, h, cfg, cmd, opts)
+			results[i] = r
+			if r.Status == HostFailed || r.Status == HostUnreachable {
+				log.Warnf("fleet %s %s: %v", hostName(h), r.Status, r.Err)
+				if opts.FailFast {
+					cancel()
+				}
+			}
+		}(i, h)
+	}
+	wg.Wait()
+
+	summary := &FleetSummary{Results: results}
+	for _, r := range results {
+		name := hostName(r.Host)
+		switch r.Status {
+		case HostSucceeded:
+			summary.Succeeded = append(summary.Succeeded, name)
+		case HostFailed:
+			summary.Failed = append(summary.Failed, name)
+		case HostUnreachable:
+			summary.Unreachable = append(summary.Unreachable, name)
+		case HostSkipped:
+			summary.Skipped = append(summary.Skipped, name)
+		case HostCancelled:
+			summary.Cancelled = append(summary.Cancelled, name)
+		}
+	}
+	return summary
+}
+
+func runFleetHost(parent context.Context, h *Host, cfg ssh.Config, cmd string, opts *FleetOptions) *FleetResult {
+	ctx := parent
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	conn, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		r := &FleetResult{Host: h, Status: HostFailed, Err: err}
+		switch {
+		case parent.Err() != nil:
+			// 还未建立连接时整体被取消
+			r.Status = HostSkipped
+		case unreachable(err):
+			r.Status = HostUnreachable
+		}
+		return r
+	}
+	defer release()
+
+	var result *CommandResult
+	if opts.Sudo {
+		result, err = sudoCommand(ctx, conn, h, cmd, opts.Envs...)
+	} else {
+		result, err = runCommand(ctx, conn, h, cmd, opts.Envs...)
+	}
+
+	r := &FleetResult{Host: h, Result: result, Err: err}
+	switch {
+	case err == nil:
+		r.Status = HostSucceeded
+	case errors.Is(err, context.Canceled) && parent.Err() != nil:
+		// 执行中被 FailFast 或调用方取消，不是这台主机的问题
+		r.Status = HostCancelled
+	default:
+		r.Status = HostFailed
+	}
+	return r
+}
+
+// 只有网络不通、超时和握手时连接被断开才算不可达，
+// 认证失败、主机公钥不一致和本地配置错误算执行失败
+func unreachable(err error) bool {
+	var (
+		netErr     net.Error
+		channelErr *ssh.OpenChannelError
+	)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr):
+		return true
+	case errors.As(err, &channelErr):
+		// 跳板机连接不到下一跳
+		return channelErr.Reason == ssh.ConnectionFailed
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,67 @@
+package base
+
+import (
+	"context"
+	"infra/base/sshtest"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunFleetStatus(t *testing.T) {
+	s, ok := newTestServer(t, &sshtest.Config{})
+	s.Respond("uptime", "up\n", 0)
+
+	wrongPassword := *ok
+	wrongPassword.Name, wrongPassword.Password = "wrong-password", "wrong"
+	badKey := *ok
+	badKey.Name, badKey.HostKeyFingerprint = "bad-host-key", "SHA256:bad"
+
+	// 监听后立即关闭，得到一个没有服务的端口
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := *ok
+	closed.Name, closed.Port = "closed", listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	ok.Name = "ok"
+	summary := RunFleet(context.Background(), []*Host{ok, &wrongPassword, &badKey, &closed},
+		ssh.Config{}, "uptime", &FleetOptions{})
+	want := map[string]HostStatus{
+		"ok":             HostSucceeded,
+		"wrong-password": HostFailed,
+		"bad-host-key":   HostFailed,
+		"closed":         HostUnreachable,
+	}
+	for _, r := range summary.Results {
+		if r.Status != want[r.Host.Name] {
+			t.Errorf("%s: status %s, want %s: %v", r.Host.Name, r.Status, want[r.Host.Name], r.Err)
+		}
+	}
+}
+
+func TestRunFleetFailFast(t *testing.T) {
+	slowServer, slow := newTestServer(t, &sshtest.Config{})
+	slowServer.Handle("work", func(req *sshtest.Request) int {
+		<-req.Context().Done()
+		return 1
+	})
+	failingServer, failing := newTestServer(t, &sshtest.Config{})
+	failingServer.Handle("work", func(req *sshtest.Request) int {
+		time.Sleep(100 * time.Millisecond)
+		return 1
+	})
+
+	slow.Name, failing.Name = "slow", "failing"
+	summary := RunFleet(context.Background(), []*Host{slow, failing}, ssh.Config{}, "work", &FleetOptions{FailFast: true})
+	if len(summary.Failed) != 1 || summary.Failed[0] != "failing" {
+		t.Fatalf("failed = %v", summary.Failed)
+	}
+	if len(summary.Cancelled) != 1 || summary.Cancelled[0] != "slow" {
+		t.Fatalf("cancelled = %v", summary.Cancelled)
+	}
+}
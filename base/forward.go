@@ -0,0 +1,341 @@
+package base
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// 端口转发句柄
+type Forward struct {
+	listener net.Listener
+	release  func()
+	dial     func(addr string) (net.Conn, error)
+	target   string
+	errs     chan error
+	mutex    sync.Mutex
+	err      error
+	closed   bool
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+}
+
+// 监听地址，本地转发和动态转发为本地地址，远程转发为远程主机上的地址
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// 监听端口，监听 :0 时用于获取实际分配的端口
+func (f *Forward) Port() int {
+	if addr, ok := f.listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	_, port, _ := net.SplitHostPort(f.listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// 单个连接的转发错误，缓冲区满时丢弃
+func (f *Forward) Errors() <-chan error {
+	return f.errs
+}
+
+// 监听异常退出时的错误，正常 Close 时为 nil
+func (f *Forward) Err() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+// 停止监听并关闭已有连接
+func (f *Forward) Close() error {
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return nil
+	}
+	f.closed = true
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mutex.Unlock()
+
+	err := f.listener.Close()
+	f.wg.Wait()
+	f.release()
+	return err
+}
+
+func (f *Forward) reportError(err error) {
+	log.Debug("ssh forward: ", err)
+	select {
+	case f.errs <- err:
+	default:
+	}
+}
+
+func (f *Forward) serve(handle func(conn net.Conn)) {
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := f.listener.Accept()
+			if err != nil {
+				f.mutex.Lock()
+				// ssh 连接断开时已记录原因
+				if !f.closed && f.err == nil {
+					f.err = err
+				}
+				f.mutex.Unlock()
+				return
+			}
+			f.mutex.Lock()
+			if f.closed {
+				f.mutex.Unlock()
+				conn.Close()
+				return
+			}
+			f.conns[conn] = struct{}{}
+			f.wg.Add(1)
+			f.mutex.Unlock()
+
+			go func() {
+				defer f.wg.Done()
+				handle(conn)
+				f.mutex.Lock()
+				delete(f.conns, conn)
+				f.mutex.Unlock()
+			}()
+		}
+	}()
+}
+
+// ssh 连接断开后停止监听，Err 返回断开的原因
+func (f *Forward) watch(client *ssh.Client) {
+	err := client.Wait()
+	f.mutex.Lock()
+	if f.closed {
+		f.mutex.Unlock()
+		return
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	f.err = fmt.Errorf("ssh connection closed: %w", err)
+	f.mutex.Unlock()
+	f.listener.Close()
+}
+
+func (f *Forward) forward(conn net.Conn) {
+	defer conn.Close()
+	remote, err := f.dial(f.target)
+	if err != nil {
+		f.reportError(fmt.Errorf("dial %s: %w", f.target, err))
+		return
+	}
+	defer remote.Close()
+	pipe(conn, remote)
+}
+
+// 半关闭写方向，*net.TCPConn 和 ssh 通道都支持
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// 双向复制直到两个方向都结束，一端读到 EOF 后只关闭另一端的写方向，
+// 对方仍可以继续返回数据，出错时关闭两端
+func pipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	copyConn := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			_ = cw.CloseWrite()
+			return
+		}
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go copyConn(a, b)
+	go copyConn(b, a)
+	wg.Wait()
+}
+
+func newForward(h *Host, cfg ssh.Config, listen func(client *ssh.Client) (net.Listener, error)) (*Forward, *ssh.Client, error) {
+	client, release, err := openSSHClient(context.Background(), h, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	listener, err := listen(client)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	f := &Forward{
+		listener: listener,
+		release:  release,
+		errs:     make(chan error, 16),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	go f.watch(client)
+	return f, client, nil
+}
+
+// 本地转发，在本地 localAddr 监听，通过主机连接 remoteAddr，相当于 ssh -L
+func LocalForward(h *Host, cfg ssh.Config, localAddr string, remoteAddr string) (*Forward, error) {
+	f, client, err := newForward(h, cfg, func(client *ssh.Client) (net.Listener, error) {
+		return net.Listen("tcp", localAddr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.target = remoteAddr
+	f.dial = func(addr string) (net.Conn, error) {
+		return client.Dial("tcp", addr)
+	}
+	f.serve(f.forward)
+	return f, nil
+}
+
+// 远程转发，在主机上 remoteAddr 监听，连接转发到本地可访问的 localAddr，相当于 ssh -R
+func RemoteForward(h *Host, cfg ssh.Config, remoteAddr string, localAddr string) (*Forward, error) {
+	f, _, err := newForward(h, cfg, func(client *ssh.Client) (net.Listener, error) {
+		return client.Listen("tcp", remoteAddr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.target = localAddr
+	f.dial = func(addr string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	}
+	f.serve(f.forward)
+	return f, nil
+}
+
+// 动态转发，在本地 localAddr 提供 SOCKS5 代理，相当于 ssh -D
+func DynamicForward(h *Host, cfg ssh.Config, localAddr string) (*Forward, error) {
+	f, client, err := newForward(h, cfg, func(client *ssh.Client) (net.Listener, error) {
+		return net.Listen("tcp", localAddr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.dial = func(addr string) (net.Conn, error) {
+		return client.Dial("tcp", addr)
+	}
+	f.serve(f.socks5)
+	return f, nil
+}
+
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+	socks5Succeeded    = 0x00
+	socks5Failure      = 0x01
+	socks5NotSupported = 0x07
+)
+
+// 只支持无认证的 CONNECT 请求
+func (f *Forward) socks5(conn net.Conn) {
+	defer conn.Close()
+
+	addr, err := socks5Handshake(conn)
+	if err != nil {
+		f.reportError(fmt.Errorf("socks5: %w", err))
+		return
+	}
+	remote, err := f.dial(addr)
+	if err != nil {
+		_, _ = conn.Write([]byte{socks5Version, socks5Failure, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		f.reportError(fmt.Errorf("dial %s: %w", addr, err))
+		return
+	}
+	defer remote.Close()
+	_, err = conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return
+	}
+	pipe(conn, remote)
+}
+
+func socks5Handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	noAuth := false
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return "", errors.New("no acceptable auth method")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5NoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socks5Connect {
+		_, _ = conn.Write([]byte{socks5Version, socks5NotSupported, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5IPv4, socks5IPv6:
+		size := net.IPv4len
+		if request[3] == socks5IPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5Domain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
@@ -0,0 +1,88 @@
+package base
+
+import (
+	"fmt"
+	"infra/base/sshtest"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 读完整个请求后返回收到的字节数，用于检查半关闭
+func newCountServer(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, _ := ioutil.ReadAll(conn)
+				fmt.Fprintf(conn, "got %d bytes", len(b))
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestLocalForwardHalfClose(t *testing.T) {
+	_, h := newTestServer(t, &sshtest.Config{})
+	target := newCountServer(t)
+
+	f, err := LocalForward(h, ssh.Config{}, "127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	// 发送完请求后半关闭，仍然要收到响应
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "got 7 bytes" {
+		t.Fatalf("response = %q, %v", b, err)
+	}
+}
+
+func TestLocalForwardConnectionLost(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	target := newCountServer(t)
+
+	f, err := LocalForward(h, ssh.Config{}, "127.0.0.1:0", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Err() is still nil after the ssh connection closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := net.Dial("tcp", f.Addr().String()); err == nil {
+		t.Fatal("listener still accepts connections")
+	}
+}
@@ -1,5 +1,7 @@
 package base
 
+import "time"
+
 type Host struct {
 	Name     string   `json:"name"`
 	Ip       string   `json:"ip"`
@@ -9,6 +11,28 @@ type Host struct {
 	KeyFile  string   `json:"keyFile"`
 	Platform Platform `json:"platform"`
 	AuthType authType `json:"authType"`
+	// 私钥密码
+	Passphrase string `json:"passphrase"`
+	// PEM 格式的私钥内容，用于 PrivateKeyAuth 和 CertificateAuth
+	PrivateKey string `json:"privateKey"`
+	// OpenSSH 用户证书文件(xxx-cert.pub)，用于 CertificateAuth
+	CertFile string `json:"certFile"`
+	// 主机公钥校验策略，为空时不校验
+	HostKeyPolicy HostKeyPolicy `json:"hostKeyPolicy"`
+	// known_hosts 文件路径，为空时使用 ~/.ssh/known_hosts
+	KnownHostsFile string `json:"knownHostsFile"`
+	// FingerprintHostKey 策略下期望的公钥指纹，如 SHA256:xxxx
+	HostKeyFingerprint string `json:"hostKeyFingerprint"`
+	// 拨号和握手超时时间，为空时默认 5 秒
+	Timeout time.Duration `json:"timeout"`
+	// 跳板机，按顺序逐跳连接，每台跳板机使用自己的认证信息
+	Jumps []*Host `json:"jumps"`
+	// 环境变量传递方式，为空时 Setenv 被拒绝后自动改为 export 前缀
+	EnvMode EnvMode `json:"envMode"`
+	// 连接失败时的重试策略，为空时不重试
+	Retry *RetryPolicy `json:"retry"`
+	// 到这台主机的全部 sftp 传输共享的带宽，字节/秒，为 0 时不限制
+	BandwidthLimit int64 `json:"bandwidthLimit"`
 }
 
 type Platform string
@@ -25,4 +49,14 @@ type authType string
 const (
 	PasswordAuth authType = "password"
 	KeyFileAuth  authType = "keyFile"
+	// 带密码保护的私钥文件，密码为 Passphrase
+	PassphraseKeyFileAuth authType = "passphraseKeyFile"
+	// 内存中的 PEM 私钥，内容为 PrivateKey
+	PrivateKeyAuth authType = "privateKey"
+	// 通过 SSH_AUTH_SOCK 使用 ssh-agent
+	AgentAuth authType = "agent"
+	// keyboard-interactive，所有提问都用 Password 应答
+	KeyboardInteractiveAuth authType = "keyboardInteractive"
+	// OpenSSH 用户证书
+	CertificateAuth authType = "certificate"
 )
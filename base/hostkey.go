@@ -0,0 +1,237 @@
+package base
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 主机公钥校验策略
+type HostKeyPolicy string
+
+const (
+	// 不校验主机公钥，兼容旧版本的默认行为
+	InsecureHostKey HostKeyPolicy = "insecure"
+	// 严格按照 known_hosts 文件校验，未知主机直接拒绝
+	KnownHostsHostKey HostKeyPolicy = "knownHosts"
+	// 首次连接时信任并写入 known_hosts，之后严格校验
+	TrustOnFirstUseHostKey HostKeyPolicy = "tofu"
+	// 校验固定的公钥指纹(ssh.FingerprintSHA256 格式)
+	FingerprintHostKey HostKeyPolicy = "fingerprint"
+)
+
+const defaultKnownHostsFile = "~/.ssh/known_hosts"
+
+// 未在 known_hosts 中找到主机公钥
+type UnknownHostKeyError struct {
+	Host        string
+	Addr        string
+	Fingerprint string
+}
+
+func (e *UnknownHostKeyError) Error() string {
+	return fmt.Sprintf("unknown host key for %s(%s): %s", e.Host, e.Addr, e.Fingerprint)
+}
+
+// 主机公钥与记录不一致，可能存在中间人攻击
+type HostKeyMismatchError struct {
+	Host        string
+	Addr        string
+	Fingerprint string
+	Want        []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s(%s): got %s, want %s",
+		e.Host, e.Addr, e.Fingerprint, strings.Join(e.Want, ","))
+}
+
+// 同一进程内对 known_hosts 文件的追加需要串行
+var knownHostsLock sync.Mutex
+
+func hostKeyCallback(h *Host) (ssh.HostKeyCallback, error) {
+	switch h.HostKeyPolicy {
+	case "", InsecureHostKey:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case KnownHostsHostKey:
+		return knownHostsCallback(h, false)
+	case TrustOnFirstUseHostKey:
+		return knownHostsCallback(h, true)
+	case FingerprintHostKey:
+		return fingerprintCallback(h)
+	default:
+		return nil, fmt.Errorf("unsupported host key policy: %s", h.HostKeyPolicy)
+	}
+}
+
+func knownHostsPath(h *Host) (string, error) {
+	path := h.KnownHostsFile
+	if path == "" {
+		path = defaultKnownHostsFile
+	}
+	return homedir.Expand(path)
+}
+
+func knownHostsCallback(h *Host, trustOnFirstUse bool) (ssh.HostKeyCallback, error) {
+	path, err := knownHostsPath(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if trustOnFirstUse {
+		// 文件不存在时先创建，knownhosts.New 要求文件存在
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		// 只记录了其它类型的公钥时按未知处理，与 OpenSSH 一致
+		if hasKeyType(keyErr.Want, key.Type()) {
+			want := make([]string, 0, len(keyErr.Want))
+			for _, k := range keyErr.Want {
+				want = append(want, ssh.FingerprintSHA256(k.Key))
+			}
+			return &HostKeyMismatchError{Host: hostName(h), Addr: hostname, Fingerprint: fingerprint, Want: want}
+		}
+		if !trustOnFirstUse {
+			return &UnknownHostKeyError{Host: hostName(h), Addr: hostname, Fingerprint: fingerprint}
+		}
+		return appendKnownHost(path, hostname, remote, key)
+	}, nil
+}
+
+func hasKeyType(keys []knownhosts.KnownKey, keyType string) bool {
+	for _, k := range keys {
+		if k.Key.Type() == keyType {
+			return true
+		}
+	}
+	return false
+}
+
+// known_hosts 中记录了这台主机的公钥时，只协商这些类型的主机公钥，
+// 否则服务端可能出示未记录的 RSA 公钥，没有记录时返回 nil 使用默认顺序
+func hostKeyAlgorithms(h *Host) ([]string, error) {
+	if h.HostKeyPolicy != KnownHostsHostKey && h.HostKeyPolicy != TrustOnFirstUseHostKey {
+		return nil, nil
+	}
+	path, err := knownHostsPath(h)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	addr := hostAddr(h)
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	// 用不存在的公钥类型查询，KeyError.Want 为记录的全部公钥
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(addr, remote, probeKey{}), &keyErr) {
+		return nil, nil
+	}
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, k := range keyErr.Want {
+		keyType := k.Key.Type()
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		if keyType == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	return algorithms, nil
+}
+
+// 查询 known_hosts 用的公钥，类型不会与任何记录匹配
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "base-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("base-probe")
+}
+
+func (probeKey) Verify([]byte, *ssh.Signature) error {
+	return errors.New("probe key cannot verify")
+}
+
+func appendKnownHost(path string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(knownhosts.Line(addresses, key) + "\n")
+	return err
+}
+
+func fingerprintCallback(h *Host) (ssh.HostKeyCallback, error) {
+	if h.HostKeyFingerprint == "" {
+		return nil, fmt.Errorf("host %s: hostKeyFingerprint is required for policy %s", hostName(h), FingerprintHostKey)
+	}
+	want := strings.TrimSpace(h.HostKeyFingerprint)
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		got := ssh.FingerprintSHA256(key)
+		// 兼容直接配置公钥内容的写法
+		if got == want || bytes.Equal(key.Marshal(), parseAuthorizedKey(want)) {
+			return nil
+		}
+		return &HostKeyMismatchError{Host: hostName(h), Addr: hostname, Fingerprint: got, Want: []string{want}}
+	}, nil
+}
+
+func parseAuthorizedKey(content string) []byte {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(content))
+	if err != nil {
+		return nil
+	}
+	return key.Marshal()
+}
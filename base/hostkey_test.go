@@ -0,0 +1,107 @@
+package base
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"infra/base/sshtest"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// 服务端同时有 ed25519 和 RSA 主机公钥，与 OpenSSH 的默认配置一致
+func newMultiKeyServer(t *testing.T) (*sshtest.Server, *Host) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, h := newTestServer(t, &sshtest.Config{ExtraHostKeys: []ssh.Signer{signer}})
+	s.Respond("hostname", "box\n", 0)
+	h.KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	return s, h
+}
+
+func writeKnownHosts(t *testing.T, h *Host, key ssh.PublicKey) {
+	t.Helper()
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostAddr(h))}, key) + "\n"
+	if err := ioutil.WriteFile(h.KnownHostsFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownHostsHostKey(t *testing.T) {
+	s, h := newMultiKeyServer(t)
+	h.HostKeyPolicy = KnownHostsHostKey
+
+	// 未知主机直接拒绝
+	if err := ioutil.WriteFile(h.KnownHostsFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var unknown *UnknownHostKeyError
+	if _, err := RunCmd(h, ssh.Config{}, "hostname"); !errors.As(err, &unknown) || unknown.Host != h.Ip {
+		t.Fatalf("error = %v, want UnknownHostKeyError", err)
+	}
+
+	// 只记录了 ed25519 公钥
+	writeKnownHosts(t, h, s.HostKey)
+	if out, err := RunCmd(h, ssh.Config{}, "hostname"); err != nil || out != "box\n" {
+		t.Fatalf("RunCmd = %q, %v", out, err)
+	}
+
+	// 同类型的公钥不一致
+	writeKnownHosts(t, h, mustNewKey(t).PublicKey())
+	var mismatch *HostKeyMismatchError
+	if _, err := RunCmd(h, ssh.Config{}, "hostname"); !errors.As(err, &mismatch) {
+		t.Fatalf("error = %v, want HostKeyMismatchError", err)
+	}
+}
+
+func TestTrustOnFirstUseHostKey(t *testing.T) {
+	s, h := newMultiKeyServer(t)
+	h.HostKeyPolicy = TrustOnFirstUseHostKey
+
+	// 首次连接写入 known_hosts，之后按记录校验
+	for i := 0; i < 2; i++ {
+		if out, err := RunCmd(h, ssh.Config{}, "hostname"); err != nil || out != "box\n" {
+			t.Fatalf("RunCmd = %q, %v", out, err)
+		}
+	}
+	b, err := ioutil.ReadFile(h.KnownHostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 1 {
+		t.Fatalf("known_hosts has %d lines, want 1", lines)
+	}
+
+	// 只记录了 ed25519 公钥时不报不一致
+	writeKnownHosts(t, h, s.HostKey)
+	if out, err := RunCmd(h, ssh.Config{}, "hostname"); err != nil || out != "box\n" {
+		t.Fatalf("RunCmd = %q, %v", out, err)
+	}
+
+	writeKnownHosts(t, h, mustNewKey(t).PublicKey())
+	var mismatch *HostKeyMismatchError
+	if _, err := RunCmd(h, ssh.Config{}, "hostname"); !errors.As(err, &mismatch) {
+		t.Fatalf("error = %v, want HostKeyMismatchError", err)
+	}
+}
+
+func mustNewKey(t *testing.T) *sshtest.Key {
+	t.Helper()
+	key, err := sshtest.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,249 @@
+package base
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type ServiceAction string
+
+const (
+	ServiceStart   ServiceAction = "start"
+	ServiceStop    ServiceAction = "stop"
+	ServiceRestart ServiceAction = "restart"
+	ServiceStatus  ServiceAction = "status"
+)
+
+type ChecksumAlgorithm string
+
+const (
+	MD5Checksum    ChecksumAlgorithm = "md5"
+	SHA256Checksum ChecksumAlgorithm = "sha256"
+)
+
+// 文件系统使用情况，单位为字节
+type FileSystemUsage struct {
+	FileSystem string `json:"fileSystem"`
+	MountPoint string `json:"mountPoint"`
+	Total      uint64 `json:"total"`
+	Used       uint64 `json:"used"`
+	Free       uint64 `json:"free"`
+}
+
+// 内存信息，单位为字节
+type MemoryInfo struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+type ProcessInfo struct {
+	Pid     int    `json:"pid"`
+	PPid    int    `json:"ppid"`
+	User    string `json:"user"`
+	Command string `json:"command"`
+}
+
+// 创建用户参数，除 Name 外为空时使用系统默认值
+type UserSpec struct {
+	Name  string `json:"name"`
+	Uid   int    `json:"uid"`
+	Group string `json:"group"`
+	Home  string `json:"home"`
+	Shell string `json:"shell"`
+}
+
+// 各平台常用操作的命令及输出解析
+type PlatformAdapter interface {
+	Platform() Platform
+	// path 为空时返回所有文件系统
+	DiskUsageCmd(path string) string
+	ParseDiskUsage(output string) ([]FileSystemUsage, error)
+	MemoryCmd() string
+	ParseMemory(output string) (*MemoryInfo, error)
+	// 输出格式为 pid ppid user args
+	ProcessListCmd() string
+	CreateUserCmd(user *UserSpec) string
+	ChecksumCmd(path string, algorithm ChecksumAlgorithm) string
+	ServiceCmd(name string, action ServiceAction) string
+}
+
+func NewPlatformAdapter(platform Platform) (PlatformAdapter, error) {
+	switch platform {
+	case LinuxPlatform:
+		return linuxAdapter{}, nil
+	case AIXPlatform:
+		return aixAdapter{}, nil
+	case SunOsPlatform:
+		return sunOsAdapter{}, nil
+	case HPPlatform:
+		return hpAdapter{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported platform: %s", platform)
+	}
+}
+
+// 通过 uname -s 识别平台
+func DetectPlatform(ctx context.Context, h *Host, cfg ssh.Config) (Platform, error) {
+	result, err := RunCmdResultContext(ctx, h, cfg, "uname -s")
+	if err != nil {
+		return "", err
+	}
+	return parsePlatform(result.Stdout)
+}
+
+func parsePlatform(uname string) (Platform, error) {
+	switch name := strings.TrimSpace(uname); name {
+	case "Linux":
+		return LinuxPlatform, nil
+	case "AIX":
+		return AIXPlatform, nil
+	case "SunOS":
+		return SunOsPlatform, nil
+	case "HP-UX":
+		return HPPlatform, nil
+	default:
+		return "", fmt.Errorf("unsupported platform: %s", name)
+	}
+}
+
+// 按主机平台执行常用操作
+type PlatformOps struct {
+	Host    *Host
+	Cfg     ssh.Config
+	Adapter PlatformAdapter
+	// 创建用户、服务控制等操作通过 sudo 执行
+	Sudo bool
+}
+
+// Host.Platform 为空时自动识别并回填
+func NewPlatformOps(ctx context.Context, h *Host, cfg ssh.Config) (*PlatformOps, error) {
+	if h.Platform == "" {
+		platform, err := DetectPlatform(ctx, h, cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.Platform = platform
+	}
+	adapter, err := NewPlatformAdapter(h.Platform)
+	if err != nil {
+		return nil, err
+	}
+	return &PlatformOps{Host: h, Cfg: cfg, Adapter: adapter}, nil
+}
+
+func (o *PlatformOps) run(ctx context.Context, cmd string) (*CommandResult, error) {
+	return RunCmdResultContext(ctx, o.Host, o.Cfg, cmd)
+}
+
+func (o *PlatformOps) runPrivileged(ctx context.Context, cmd string) (*CommandResult, error) {
+	if o.Sudo {
+		return RunAsCmdContext(ctx, o.Host, o.Cfg, cmd, &EscalateOptions{})
+	}
+	return o.run(ctx, cmd)
+}
+
+func (o *PlatformOps) DiskUsage(ctx context.Context, path string) ([]FileSystemUsage, error) {
+	result, err := o.run(ctx, o.Adapter.DiskUsageCmd(path))
+	if err != nil {
+		return nil, err
+	}
+	return o.Adapter.ParseDiskUsage(result.Stdout)
+}
+
+func (o *PlatformOps) Memory(ctx context.Context) (*MemoryInfo, error) {
+	result, err := o.run(ctx, o.Adapter.MemoryCmd())
+	if err != nil {
+		return nil, err
+	}
+	return o.Adapter.ParseMemory(result.Stdout)
+}
+
+func (o *PlatformOps) Processes(ctx context.Context) ([]ProcessInfo, error) {
+	result, err := o.run(ctx, o.Adapter.ProcessListCmd())
+	if err != nil {
+		return nil, err
+	}
+	return parseProcessList(result.Stdout)
+}
+
+func (o *PlatformOps) CreateUser(ctx context.Context, user *UserSpec) error {
+	_, err := o.runPrivileged(ctx, o.Adapter.CreateUserCmd(user))
+	return err
+}
+
+func (o *PlatformOps) Checksum(ctx context.Context, path string, algorithm ChecksumAlgorithm) (string, error) {
+	result, err := o.run(ctx, o.Adapter.ChecksumCmd(path, algorithm))
+	if err != nil {
+		return "", err
+	}
+	return parseChecksum(result.Stdout, algorithm)
+}
+
+func (o *PlatformOps) Service(ctx context.Context, name string, action ServiceAction) (*CommandResult, error) {
+	return o.runPrivileged(ctx, o.Adapter.ServiceCmd(name, action))
+}
+
+var checksumRegexp = map[ChecksumAlgorithm]*regexp.Regexp{
+	MD5Checksum:    regexp.MustCompile(`\b[0-9a-fA-F]{32}\b`),
+	SHA256Checksum: regexp.MustCompile(`\b[0-9a-fA-F]{64}\b`),
+}
+
+// 各平台工具输出格式不同，直接提取十六进制摘要
+func parseChecksum(output string, algorithm ChecksumAlgorithm) (string, error) {
+	re, ok := checksumRegexp[algorithm]
+	if !ok {
+		return "", fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	sum := re.FindString(output)
+	if sum == "" {
+		return "", fmt.Errorf("cannot parse %s checksum from: %s", algorithm, strings.TrimSpace(output))
+	}
+	return strings.ToLower(sum), nil
+}
+
+func parseProcessList(output string) ([]ProcessInfo, error) {
+	var processes []ProcessInfo
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			// 表头
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		processes = append(processes, ProcessInfo{
+			Pid:     pid,
+			PPid:    ppid,
+			User:    fields[2],
+			Command: strings.Join(fields[3:], " "),
+		})
+	}
+	return processes, scanner.Err()
+}
+
+func useraddCmd(user *UserSpec) string {
+	args := []string{"useradd", "-m"}
+	if user.Uid > 0 {
+		args = append(args, "-u", strconv.Itoa(user.Uid))
+	}
+	if user.Group != "" {
+		args = append(args, "-g", user.Group)
+	}
+	if user.Home != "" {
+		args = append(args, "-d", user.Home)
+	}
+	if user.Shell != "" {
+		args = append(args, "-s", user.Shell)
+	}
+	return shellJoin(append(args, user.Name)...)
+}
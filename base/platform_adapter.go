@@ -0,0 +1,367 @@
+package base
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type linuxAdapter struct{}
+
+func (linuxAdapter) Platform() Platform {
+	return LinuxPlatform
+}
+
+func (linuxAdapter) DiskUsageCmd(path string) string {
+	return dfCmd("df -kP", path)
+}
+
+func (linuxAdapter) ParseDiskUsage(output string) ([]FileSystemUsage, error) {
+	return parsePosixDf(output)
+}
+
+func (linuxAdapter) MemoryCmd() string {
+	return "cat /proc/meminfo"
+}
+
+func (linuxAdapter) ParseMemory(output string) (*MemoryInfo, error) {
+	values := make(map[string]uint64)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = v * 1024
+	}
+	total, ok := values["MemTotal"]
+	if !ok {
+		return nil, errors.New("cannot parse MemTotal from /proc/meminfo")
+	}
+	// 老内核没有 MemAvailable
+	free, ok := values["MemAvailable"]
+	if !ok {
+		free = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+	return &MemoryInfo{Total: total, Free: free}, nil
+}
+
+func (linuxAdapter) ProcessListCmd() string {
+	return "ps -eo pid,ppid,user,args"
+}
+
+func (linuxAdapter) CreateUserCmd(user *UserSpec) string {
+	return useraddCmd(user)
+}
+
+func (linuxAdapter) ChecksumCmd(path string, algorithm ChecksumAlgorithm) string {
+	return string(algorithm) + "sum " + shellQuote(path)
+}
+
+func (linuxAdapter) ServiceCmd(name string, action ServiceAction) string {
+	name = shellQuote(name)
+	return fmt.Sprintf("if command -v systemctl >/dev/null 2>&1; then systemctl %s %s; else service %s %s; fi",
+		action, name, name, action)
+}
+
+type aixAdapter struct{}
+
+func (aixAdapter) Platform() Platform {
+	return AIXPlatform
+}
+
+func (aixAdapter) DiskUsageCmd(path string) string {
+	return dfCmd("df -k", path)
+}
+
+// Filesystem 1024-blocks Free %Used Iused %Iused Mounted on
+func (aixAdapter) ParseDiskUsage(output string) ([]FileSystemUsage, error) {
+	var usages []FileSystemUsage
+	for _, fields := range dfLines(output) {
+		if len(fields) < 7 {
+			continue
+		}
+		total, err1 := strconv.ParseUint(fields[1], 10, 64)
+		free, err2 := strconv.ParseUint(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			// /proc 等伪文件系统的值为 -
+			continue
+		}
+		usages = append(usages, FileSystemUsage{
+			FileSystem: fields[0],
+			MountPoint: strings.Join(fields[6:], " "),
+			Total:      total * 1024,
+			Used:       (total - free) * 1024,
+			Free:       free * 1024,
+		})
+	}
+	return usages, nil
+}
+
+func (aixAdapter) MemoryCmd() string {
+	return "vmstat -v"
+}
+
+// 输出中的 "memory pages" 和 "free pages" 两行，页大小为 4K
+func (aixAdapter) ParseMemory(output string) (*MemoryInfo, error) {
+	const pageSize = 4096
+	info := &MemoryInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.Join(fields[1:], " ") {
+		case "memory pages":
+			info.Total = v * pageSize
+		case "free pages":
+			info.Free = v * pageSize
+		}
+	}
+	if info.Total == 0 {
+		return nil, errors.New("cannot parse memory pages from vmstat -v")
+	}
+	return info, nil
+}
+
+func (aixAdapter) ProcessListCmd() string {
+	return "ps -eo pid,ppid,user,args"
+}
+
+func (aixAdapter) CreateUserCmd(user *UserSpec) string {
+	args := []string{"mkuser"}
+	if user.Uid > 0 {
+		args = append(args, "id="+strconv.Itoa(user.Uid))
+	}
+	if user.Group != "" {
+		args = append(args, "pgrp="+user.Group)
+	}
+	if user.Home != "" {
+		args = append(args, "home="+user.Home)
+	}
+	if user.Shell != "" {
+		args = append(args, "shell="+user.Shell)
+	}
+	return shellJoin(append(args, user.Name)...)
+}
+
+func (aixAdapter) ChecksumCmd(path string, algorithm ChecksumAlgorithm) string {
+	return "csum -h " + strings.ToUpper(string(algorithm)) + " " + shellQuote(path)
+}
+
+// AIX 服务由 SRC 管理
+func (aixAdapter) ServiceCmd(name string, action ServiceAction) string {
+	name = shellQuote(name)
+	switch action {
+	case ServiceStart:
+		return "startsrc -s " + name
+	case ServiceStop:
+		return "stopsrc -s " + name
+	case ServiceRestart:
+		// stopsrc 只发出停止请求，等子系统变为 inoperative 后再启动
+		return fmt.Sprintf("stopsrc -s %[1]s; i=0; until lssrc -s %[1]s | grep -qw inoperative; do "+
+			"if [ $i -ge %[2]d ]; then echo \"subsystem %[1]s did not stop in %[2]d seconds\" >&2; exit 1; fi; "+
+			"sleep 1; i=$((i+1)); done; startsrc -s %[1]s", name, serviceStopTimeout)
+	default:
+		return "lssrc -s " + name
+	}
+}
+
+// 重启时等待服务停止的秒数
+const serviceStopTimeout = 30
+
+type sunOsAdapter struct{}
+
+func (sunOsAdapter) Platform() Platform {
+	return SunOsPlatform
+}
+
+func (sunOsAdapter) DiskUsageCmd(path string) string {
+	return dfCmd("df -k", path)
+}
+
+func (sunOsAdapter) ParseDiskUsage(output string) ([]FileSystemUsage, error) {
+	return parsePosixDf(output)
+}
+
+// 总内存来自 prtconf，空闲内存为 vmstat 第二次采样的 free 列(KB)
+func (sunOsAdapter) MemoryCmd() string {
+	return "/usr/sbin/prtconf 2>/dev/null | grep 'Memory size'; vmstat 1 2 | tail -1"
+}
+
+func (sunOsAdapter) ParseMemory(output string) (*MemoryInfo, error) {
+	return parseVmstatMemory(output, 1024)
+}
+
+func (sunOsAdapter) ProcessListCmd() string {
+	return "ps -eo pid,ppid,user,args"
+}
+
+func (sunOsAdapter) CreateUserCmd(user *UserSpec) string {
+	return useraddCmd(user)
+}
+
+func (sunOsAdapter) ChecksumCmd(path string, algorithm ChecksumAlgorithm) string {
+	return "digest -a " + string(algorithm) + " " + shellQuote(path)
+}
+
+// Solaris 10 以上服务由 SMF 管理
+func (sunOsAdapter) ServiceCmd(name string, action ServiceAction) string {
+	name = shellQuote(name)
+	switch action {
+	case ServiceStart:
+		return "svcadm enable -s " + name
+	case ServiceStop:
+		return "svcadm disable -s " + name
+	case ServiceRestart:
+		return "svcadm restart " + name
+	default:
+		return "svcs -l " + name
+	}
+}
+
+type hpAdapter struct{}
+
+func (hpAdapter) Platform() Platform {
+	return HPPlatform
+}
+
+func (hpAdapter) DiskUsageCmd(path string) string {
+	return dfCmd("bdf", path)
+}
+
+func (hpAdapter) ParseDiskUsage(output string) ([]FileSystemUsage, error) {
+	return parsePosixDf(output)
+}
+
+// 总内存来自 machinfo，空闲内存为 vmstat 第二次采样的 free 列(4K 页)
+func (hpAdapter) MemoryCmd() string {
+	return "/usr/contrib/bin/machinfo 2>/dev/null | grep -i '^ *memory'; vmstat 1 2 | tail -1"
+}
+
+func (hpAdapter) ParseMemory(output string) (*MemoryInfo, error) {
+	return parseVmstatMemory(output, 4096)
+}
+
+// HP-UX 的 ps 需要 UNIX95 才支持 -o
+func (hpAdapter) ProcessListCmd() string {
+	return "UNIX95=1 ps -eo pid,ppid,user,args"
+}
+
+func (hpAdapter) CreateUserCmd(user *UserSpec) string {
+	return useraddCmd(user)
+}
+
+func (hpAdapter) ChecksumCmd(path string, algorithm ChecksumAlgorithm) string {
+	return "openssl dgst -" + string(algorithm) + " " + shellQuote(path)
+}
+
+// HP-UX 的 init.d 脚本只支持 start 和 stop
+func (hpAdapter) ServiceCmd(name string, action ServiceAction) string {
+	script := "/sbin/init.d/" + shellQuote(name)
+	switch action {
+	case ServiceStart, ServiceStop:
+		return script + " " + string(action)
+	case ServiceRestart:
+		return script + " stop; " + script + " start"
+	default:
+		// 按与脚本同名的进程判断是否在运行，没有时退出码为 1
+		return "UNIX95=1 ps -C " + shellQuote(name) + " -o pid= -o args="
+	}
+}
+
+func dfCmd(df string, path string) string {
+	if path == "" {
+		return df
+	}
+	return df + " " + shellQuote(path)
+}
+
+// 去掉表头，并把设备名过长被折行的记录合并为一行(HP-UX bdf)
+func dfLines(output string) [][]string {
+	var (
+		lines   [][]string
+		pending []string
+	)
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	header := true
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if header {
+			header = false
+			continue
+		}
+		if len(fields) == 1 {
+			pending = fields
+			continue
+		}
+		lines = append(lines, append(pending, fields...))
+		pending = nil
+	}
+	return lines
+}
+
+// Filesystem 1024-blocks Used Available Capacity Mounted on
+func parsePosixDf(output string) ([]FileSystemUsage, error) {
+	var usages []FileSystemUsage
+	for _, fields := range dfLines(output) {
+		if len(fields) < 6 {
+			continue
+		}
+		total, err1 := strconv.ParseUint(fields[1], 10, 64)
+		used, err2 := strconv.ParseUint(fields[2], 10, 64)
+		free, err3 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			continue
+		}
+		usages = append(usages, FileSystemUsage{
+			FileSystem: fields[0],
+			MountPoint: strings.Join(fields[5:], " "),
+			Total:      total * 1024,
+			Used:       used * 1024,
+			Free:       free * 1024,
+		})
+	}
+	return usages, nil
+}
+
+var memorySizeRegexp = regexp.MustCompile(`(?i)memory[^0-9]*([0-9]+)\s*(MB|Megabytes|GB|Gigabytes)`)
+
+// 第一部分为包含总内存大小的行，最后一行为 vmstat 输出，第 5 列为 free
+func parseVmstatMemory(output string, freeUnit uint64) (*MemoryInfo, error) {
+	info := &MemoryInfo{}
+	if m := memorySizeRegexp.FindStringSubmatch(output); m != nil {
+		v, _ := strconv.ParseUint(m[1], 10, 64)
+		if strings.HasPrefix(strings.ToUpper(m[2]), "G") {
+			v *= 1024
+		}
+		info.Total = v * 1024 * 1024
+	}
+	if info.Total == 0 {
+		return nil, fmt.Errorf("cannot parse memory size from: %s", strings.TrimSpace(output))
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) > 4 {
+		if free, err := strconv.ParseUint(fields[4], 10, 64); err == nil {
+			info.Free = free * freeUnit
+		}
+	}
+	return info, nil
+}
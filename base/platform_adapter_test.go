@@ -0,0 +1,163 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiskUsage(t *testing.T) {
+	const k = 1024
+	for _, c := range []struct {
+		name    string
+		adapter PlatformAdapter
+		output  string
+		want    []FileSystemUsage
+	}{
+		{
+			name:    "linux df -kP",
+			adapter: linuxAdapter{},
+			output: `Filesystem     1024-blocks     Used Available Capacity Mounted on
+/dev/sda1         51474912 20981564  27855524      43% /
+tmpfs              8152412        0   8152412       0% /dev/shm
+//nas/share     1048576000 524288000 524288000     50% /mnt/my share
+`,
+			want: []FileSystemUsage{
+				{FileSystem: "/dev/sda1", MountPoint: "/", Total: 51474912 * k, Used: 20981564 * k, Free: 27855524 * k},
+				{FileSystem: "tmpfs", MountPoint: "/dev/shm", Total: 8152412 * k, Used: 0, Free: 8152412 * k},
+				{FileSystem: "//nas/share", MountPoint: "/mnt/my share", Total: 1048576000 * k, Used: 524288000 * k, Free: 524288000 * k},
+			},
+		},
+		{
+			name:    "aix df -k",
+			adapter: aixAdapter{},
+			output: `Filesystem    1024-blocks      Free %Used    Iused %Iused Mounted on
+/dev/hd4          2097152   1523456   28%    12345     4% /
+/dev/hd2          6291456   1048576   84%    67890    21% /usr
+/proc                   -         -    -         -     -  /proc
+`,
+			want: []FileSystemUsage{
+				{FileSystem: "/dev/hd4", MountPoint: "/", Total: 2097152 * k, Used: (2097152 - 1523456) * k, Free: 1523456 * k},
+				{FileSystem: "/dev/hd2", MountPoint: "/usr", Total: 6291456 * k, Used: (6291456 - 1048576) * k, Free: 1048576 * k},
+			},
+		},
+		{
+			name:    "solaris df -k",
+			adapter: sunOsAdapter{},
+			output: `Filesystem            kbytes    used   avail capacity  Mounted on
+rpool/ROOT/solaris   30707712 4456789 22345678    17%    /
+swap                  4194304     320 4193984     1%    /tmp
+`,
+			want: []FileSystemUsage{
+				{FileSystem: "rpool/ROOT/solaris", MountPoint: "/", Total: 30707712 * k, Used: 4456789 * k, Free: 22345678 * k},
+				{FileSystem: "swap", MountPoint: "/tmp", Total: 4194304 * k, Used: 320 * k, Free: 4193984 * k},
+			},
+		},
+		{
+			name:    "hp-ux bdf",
+			adapter: hpAdapter{},
+			output: `Filesystem          kbytes    used   avail %used Mounted on
+/dev/vg00/lvol3    1048576  345672  697240   33% /
+/dev/vg00/lvol1    1835008  161192 1660560    9% /stand
+/dev/vgdata01/lvol_application_data
+                   20971520 10485760 10485760   50% /app/data
+`,
+			want: []FileSystemUsage{
+				{FileSystem: "/dev/vg00/lvol3", MountPoint: "/", Total: 1048576 * k, Used: 345672 * k, Free: 697240 * k},
+				{FileSystem: "/dev/vg00/lvol1", MountPoint: "/stand", Total: 1835008 * k, Used: 161192 * k, Free: 1660560 * k},
+				{FileSystem: "/dev/vgdata01/lvol_application_data", MountPoint: "/app/data", Total: 20971520 * k, Used: 10485760 * k, Free: 10485760 * k},
+			},
+		},
+	} {
+		got, err := c.adapter.ParseDiskUsage(c.output)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseMemory(t *testing.T) {
+	const m = 1024 * 1024
+	for _, c := range []struct {
+		name    string
+		adapter PlatformAdapter
+		output  string
+		want    *MemoryInfo
+	}{
+		{
+			name:    "linux meminfo",
+			adapter: linuxAdapter{},
+			output: `MemTotal:       16303412 kB
+MemFree:         1234567 kB
+MemAvailable:    9876543 kB
+Buffers:          345678 kB
+Cached:          7654321 kB
+HugePages_Total:       0
+`,
+			want: &MemoryInfo{Total: 16303412 * 1024, Free: 9876543 * 1024},
+		},
+		{
+			name:    "linux meminfo without MemAvailable",
+			adapter: linuxAdapter{},
+			output: `MemTotal:        8046372 kB
+MemFree:          123456 kB
+Buffers:          234567 kB
+Cached:          3456789 kB
+`,
+			want: &MemoryInfo{Total: 8046372 * 1024, Free: (123456 + 234567 + 3456789) * 1024},
+		},
+		{
+			name:    "aix vmstat -v",
+			adapter: aixAdapter{},
+			output: `              4194304 memory pages
+              3932160 lruable pages
+              1712345 free pages
+                    1 memory pools
+               567890 pinned pages
+`,
+			want: &MemoryInfo{Total: 4194304 * 4096, Free: 1712345 * 4096},
+		},
+		{
+			name:    "solaris prtconf and vmstat",
+			adapter: sunOsAdapter{},
+			output: `Memory size: 16384 Megabytes
+ 0 0 0 12345678 8388608 3 12 0 0 0 0 0 0 0 0 0  500  800  400  1  1 98
+`,
+			want: &MemoryInfo{Total: 16384 * m, Free: 8388608 * 1024},
+		},
+		{
+			name:    "hp-ux machinfo and vmstat",
+			adapter: hpAdapter{},
+			output: `Memory: 32637 MB (31.87 GB)
+    2     0     0   1234567  456789   10    2     0    0     0    0     0   1024   5000   300   2  1 97
+`,
+			want: &MemoryInfo{Total: 32637 * m, Free: 456789 * 4096},
+		},
+		{
+			name:    "hp-ux 11.23 machinfo",
+			adapter: hpAdapter{},
+			output: `   Memory = 8183 MB (7.991211 GB)
+    1     0     0    345678  123456    5    1     0    0     0    0     0    512   2000   150   1  0 99
+`,
+			want: &MemoryInfo{Total: 8183 * m, Free: 123456 * 4096},
+		},
+	} {
+		got, err := c.adapter.ParseMemory(c.output)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	for _, adapter := range []PlatformAdapter{linuxAdapter{}, aixAdapter{}, sunOsAdapter{}, hpAdapter{}} {
+		if _, err := adapter.ParseMemory(""); err == nil {
+			t.Errorf("%s: parsing empty output succeeded", adapter.Platform())
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("ssh pool closed")
+
+// SSH 连接池，按 ip:port:user 复用连接，session 和 sftp 子系统复用同一条连接
+type SSHPool struct {
+	cfg         ssh.Config
+	idleTimeout time.Duration
+	keepAlive   time.Duration
+	mutex       sync.Mutex
+	conns       map[string]*pooledConn
+	closed      bool
+	stop        chan struct{}
+}
+
+type pooledConn struct {
+	key    string
+	client *ssh.Client
+	// sftp 由 sftpLock 保护，其余字段由 SSHPool.mutex 保护
+	sftpLock sync.Mutex
+	sftp     *sftp.Client
+	lastUsed time.Time
+	refs     int
+	// 已移出连接池，最后一个使用者 release 时关闭
+	retired bool
+	dead    chan struct{}
+}
+
+func (c *pooledConn) alive() bool {
+	select {
+	case <-c.dead:
+		return false
+	default:
+		return true
+	}
+}
+
+func (c *pooledConn) close() {
+	c.sftpLock.Lock()
+	if c.sftp != nil {
+		c.sftp.Close()
+		c.sftp = nil
+	}
+	c.sftpLock.Unlock()
+	c.client.Close()
+}
+
+// idleTimeout 为连接最大空闲时间，keepAlive 为心跳间隔，为 0 时不做对应处理
+func NewSSHPool(cfg ssh.Config, idleTimeout time.Duration, keepAlive time.Duration) *SSHPool {
+	p := &SSHPool{
+		cfg:         cfg,
+		idleTimeout: idleTimeout,
+		keepAlive:   keepAlive,
+		conns:       make(map[string]*pooledConn),
+		stop:        make(chan struct{}),
+	}
+	interval := keepAlive
+	if interval <= 0 || (idleTimeout > 0 && idleTimeout < interval) {
+		interval = idleTimeout
+	}
+	if interval > 0 {
+		go p.maintain(interval)
+	}
+	return p
+}
+
+// 经过不同跳板机的相同内网地址是不同的主机
+func poolKey(h *Host) string {
+	key := fmt.Sprintf("%s@%s:%d", h.User, h.Ip, h.Port)
+	for _, jump := range h.Jumps {
+		key += " via " + poolKey(jump)
+	}
+	return key
+}
+
+// 获取主机连接，连接由连接池管理，调用方不能关闭，使用完必须调用返回的 release，之后连接可能被回收
+func (p *SSHPool) Client(h *Host) (*ssh.Client, func(), error) {
+	c, err := p.acquire(context.Background(), h, p.cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.client, p.releaser(c), nil
+}
+
+// 获取主机的 sftp 客户端，由连接池管理，调用方不能关闭，使用完必须调用返回的 release
+func (p *SSHPool) Sftp(h *Host) (*sftp.Client, func(), error) {
+	c, err := p.acquire(context.Background(), h, p.cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := p.sftpClient(c)
+	if err != nil {
+		p.release(c)
+		return nil, nil, err
+	}
+	return client, p.releaser(c), nil
+}
+
+// 多次调用只 release 一次
+func (p *SSHPool) releaser(c *pooledConn) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { p.release(c) })
+	}
+}
+
+// 连接上的 sftp 客户端，建立时不持有锁，并发建立时保留先建立的那一个
+func (p *SSHPool) sftpClient(c *pooledConn) (*sftp.Client, error) {
+	c.sftpLock.Lock()
+	client := c.sftp
+	c.sftpLock.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	client, err := sftp.NewClient(c.client, sftp.MaxPacket(maxPacket))
+	if err != nil {
+		return nil, err
+	}
+	c.sftpLock.Lock()
+	if exist := c.sftp; exist != nil {
+		c.sftpLock.Unlock()
+		client.Close()
+		return exist, nil
+	}
+	c.sftp = client
+	c.sftpLock.Unlock()
+	// sftp 子系统退出后不再复用，下次重新建立
+	go func() {
+		err := client.Wait()
+		c.sftpLock.Lock()
+		if c.sftp == client {
+			c.sftp = nil
+			log.Debugf("ssh pool sftp of %s closed: %v", c.key, err)
+		}
+		c.sftpLock.Unlock()
+	}()
+	return client, nil
+}
+
+func (p *SSHPool) acquire(ctx context.Context, h *Host, cfg ssh.Config) (*pooledConn, error) {
+	key := poolKey(h)
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, ErrPoolClosed
+	}
+	c, ok := p.conns[key]
+	if ok && c.alive() {
+		stale := c.refs == 0 && p.keepAlive > 0 && time.Since(c.lastUsed) > p.keepAlive
+		c.refs++
+		c.lastUsed = time.Now()
+		p.mutex.Unlock()
+		// 空闲较久的连接先探测一次，失效则重新建立，其他已经拿到该连接的使用者 release 后才关闭
+		if stale && !p.ping(c) {
+			p.retire(c)
+			p.release(c)
+			return p.acquire(ctx, h, cfg)
+		}
+		return c, nil
+	}
+	if ok {
+		delete(p.conns, key)
+		go c.close()
+	}
+	p.mutex.Unlock()
+
+	client, err := NewSSHClientContext(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c = &pooledConn{
+		key:      key,
+		client:   client,
+		lastUsed: time.Now(),
+		refs:     1,
+		dead:     make(chan struct{}),
+	}
+	go func(c *pooledConn) {
+		_ = c.client.Wait()
+		close(c.dead)
+	}(c)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		c.close()
+		return nil, ErrPoolClosed
+	}
+	// 并发建立了同一主机的连接时保留先入池的那一个
+	if exist, ok := p.conns[key]; ok && exist.alive() {
+		go c.close()
+		exist.refs++
+		exist.lastUsed = time.Now()
+		return exist, nil
+	}
+	p.conns[key] = c
+	return c, nil
+}
+
+func (p *SSHPool) release(c *pooledConn) {
+	p.mutex.Lock()
+	c.refs--
+	c.lastUsed = time.Now()
+	closing := c.retired && c.refs == 0
+	p.mutex.Unlock()
+	if closing {
+		c.close()
+	}
+}
+
+// 把连接移出连接池，没有使用者时立即关闭，否则在最后一个使用者 release 时关闭
+func (p *SSHPool) retire(c *pooledConn) {
+	p.mutex.Lock()
+	if exist, ok := p.conns[c.key]; ok && exist == c {
+		delete(p.conns, c.key)
+	}
+	c.retired = true
+	idle := c.refs == 0
+	p.mutex.Unlock()
+	if idle {
+		c.close()
+	}
+}
+
+func (p *SSHPool) ping(c *pooledConn) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := c.client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timeout := p.keepAlive
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	select {
+	case err := <-result:
+		return err == nil
+	case <-c.dead:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *SSHPool) maintain(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var idle, active []*pooledConn
+		p.mutex.Lock()
+		for key, c := range p.conns {
+			switch {
+			case !c.alive():
+				delete(p.conns, key)
+				idle = append(idle, c)
+			case c.refs == 0 && p.idleTimeout > 0 && time.Since(c.lastUsed) > p.idleTimeout:
+				delete(p.conns, key)
+				idle = append(idle, c)
+			default:
+				active = append(active, c)
+			}
+		}
+		p.mutex.Unlock()
+
+		for _, c := range idle {
+			log.Debugf("ssh pool evict %s", c.key)
+			c.close()
+		}
+		if p.keepAlive <= 0 {
+			continue
+		}
+		for _, c := range active {
+			if !p.ping(c) {
+				log.Debugf("ssh pool keepalive failed %s", c.key)
+				p.retire(c)
+			}
+		}
+	}
+}
+
+// 关闭连接池及所有连接
+func (p *SSHPool) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.stop)
+	conns := p.conns
+	p.conns = make(map[string]*pooledConn)
+	p.mutex.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+var sshPool *SSHPool
+var sshPoolLock sync.RWMutex
+
+// 初始化全局连接池，之后 RunCmd、ScpPut 等包级函数都会复用连接
+func InitSSHPool(cfg ssh.Config, idleTimeout time.Duration, keepAlive time.Duration) *SSHPool {
+	sshPoolLock.Lock()
+	defer sshPoolLock.Unlock()
+	if sshPool != nil {
+		return sshPool
+	}
+	sshPool = NewSSHPool(cfg, idleTimeout, keepAlive)
+	return sshPool
+}
+
+// 关闭全局连接池，包级函数恢复为每次新建连接
+func CloseSSHPool() {
+	sshPoolLock.Lock()
+	defer sshPoolLock.Unlock()
+	if sshPool != nil {
+		sshPool.Close()
+		sshPool = nil
+	}
+}
+
+func defaultSSHPool() *SSHPool {
+	sshPoolLock.RLock()
+	defer sshPoolLock.RUnlock()
+	return sshPool
+}
+
+// 获取 ssh 连接，启用全局连接池时复用连接，使用完必须调用返回的 release
+func openSSHClient(ctx context.Context, h *Host, cfg ssh.Config) (*ssh.Client, func(), error) {
+	if p := defaultSSHPool(); p != nil {
+		c, err := p.acquire(ctx, h, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return c.client, func() { p.release(c) }, nil
+	}
+	client, err := NewSSHClientContext(ctx, h, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+// 获取 sftp 客户端，启用全局连接池时复用连接，使用完必须调用返回的 release
+func openSftpClient(ctx context.Context, h *Host, cfg ssh.Config) (*sftp.Client, func(), error) {
+	_, client, release, err := openClients(ctx, h, cfg)
+	return client, release, err
+}
+
+// 在同一条连接上获取 ssh 和 sftp 客户端，使用完必须调用返回的 release
+// 指定了 sftp 参数时在池中的连接上新建 sftp 客户端，release 时关闭
+func openClients(ctx context.Context, h *Host, cfg ssh.Config, opts ...sftp.ClientOption) (*ssh.Client, *sftp.Client, func(), error) {
+	if p := defaultSSHPool(); p != nil {
+		c, err := p.acquire(ctx, h, cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(opts) > 0 {
+			client, err := sftp.NewClient(c.client, append([]sftp.ClientOption{sftp.MaxPacket(maxPacket)}, opts...)...)
+			if err != nil {
+				p.release(c)
+				return nil, nil, nil, err
+			}
+			return c.client, client, func() {
+				client.Close()
+				p.release(c)
+			}, nil
+		}
+		client, err := p.sftpClient(c)
+		if err != nil {
+			p.release(c)
+			return nil, nil, nil, err
+		}
+		return c.client, client, func() { p.release(c) }, nil
+	}
+	conn, err := NewSSHClientContext(ctx, h, cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := sftp.NewClient(conn, append([]sftp.ClientOption{sftp.MaxPacket(maxPacket)}, opts...)...)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, client, func() {
+		client.Close()
+		conn.Close()
+	}, nil
+}
@@ -0,0 +1,131 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// 建立连接失败时的重试策略，只重试网络和握手错误，认证失败、主机公钥校验失败和远程命令失败不会重试
+type RetryPolicy struct {
+	// 最大尝试次数(包括第一次)，小于等于 1 时不重试
+	MaxAttempts int `json:"maxAttempts"`
+	// 第一次重试前的等待时间，为空时为 500ms
+	InitialBackoff time.Duration `json:"initialBackoff"`
+	// 等待时间上限，为空时为 30s
+	MaxBackoff time.Duration `json:"maxBackoff"`
+	// 每次重试等待时间的倍数，小于 1 时为 2
+	Multiplier float64 `json:"multiplier"`
+	// 随机抖动比例(0~1)，实际等待时间在 d*(1-Jitter) 到 d*(1+Jitter) 之间
+	Jitter float64 `json:"jitter"`
+	// 判断错误是否可以重试，为空时使用 IsRetryable
+	Retryable func(err error) bool `json:"-"`
+}
+
+// 3 次尝试，等待 0.5s、1s，抖动 20%
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// 判断是否为可以重试的临时错误：拨号失败、超时、连接被重置、握手时连接被关闭等
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var (
+		exitErr     *ExitError
+		unknownErr  *UnknownHostKeyError
+		mismatchErr *HostKeyMismatchError
+		dnsErr      *net.DNSError
+		addrErr     *net.AddrError
+		channelErr  *ssh.OpenChannelError
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &exitErr), errors.As(err, &unknownErr), errors.As(err, &mismatchErr), errors.As(err, &addrErr):
+		return false
+	case errors.As(err, &dnsErr):
+		return !dnsErr.IsNotFound
+	case errors.As(err, &channelErr):
+		// 跳板机连接下一跳失败
+		return channelErr.Reason == ssh.ConnectionFailed
+	case errors.As(err, &netErr):
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// 第 attempt 次重试前的等待时间，attempt 从 1 开始
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, maxBackoff, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = 500 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	d := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if d > float64(maxBackoff) {
+		d = float64(maxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := math.Min(p.Jitter, 1)
+		d = d * (1 - jitter + 2*jitter*rand.Float64())
+	}
+	return time.Duration(d)
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// 按策略执行 fn，p 为 nil 时只执行一次
+func (p *RetryPolicy) do(ctx context.Context, name string, fn func() error) error {
+	if p == nil || p.MaxAttempts <= 1 {
+		return fn()
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("%s connected on attempt %d/%d", name, attempt, p.MaxAttempts)
+			}
+			return nil
+		}
+		if !p.retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			log.Errorf("%s connect attempt %d/%d failed, giving up: %v", name, attempt, p.MaxAttempts, err)
+			return fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		wait := p.backoff(attempt)
+		log.Warnf("%s connect attempt %d/%d failed, retry in %s: %v", name, attempt, p.MaxAttempts, wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
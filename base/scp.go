@@ -1,6 +1,7 @@
 package base
 
 import (
+	"context"
 	"github.com/pkg/sftp"
 	"github.com/prometheus/common/log"
 	"golang.org/x/crypto/ssh"
@@ -8,6 +9,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const maxPacket = 1 << 15
@@ -20,70 +24,347 @@ func NewSftpClient(h *Host, cfg ssh.Config) (*sftp.Client, error) {
 	return sftp.NewClient(conn, sftp.MaxPacket(maxPacket))
 }
 
-func ScpPut(h *Host, cfg ssh.Config, localPath, remotePath string) error {
-	client, err := NewSftpClient(h, cfg)
+// 传输选项
+type ScpOptions struct {
+	// 断点续传，目标文件比源文件小时从目标文件的大小处继续传输，
+	// 大小相同时只有校验和(设置了 Checksum)或修改时间一致才跳过
+	Resume bool
+	// 传输完成后校验，远程通过命令计算，为空时不校验
+	Checksum ChecksumAlgorithm
+	// 进度回调，传输前先扫描计算文件数和总大小
+	OnProgress func(progress ScpProgress)
+	// 目录传输的过滤规则，上传和下载都按源目录中的相对路径匹配
+	Filter *ScpFilter
+	// 保留模式：链接按链接传输，保留权限、修改时间和访问时间，否则链接按指向的文件传输
+	Preserve bool
+	// 保留模式下同时保留属主，需要有修改属主的权限
+	PreserveOwner bool
+	// 目录传输时同时传输的文件数，小于等于 1 时依次传输
+	Concurrency int
+	// sftp 数据包大小，为 0 时为 32KiB，超过 32KiB 时部分服务端可能不支持，且下载时不再并发读取
+	PacketSize int
+	// 每个文件的并发请求数，为 0 时使用 sftp 的默认值(下载 64，上传不并发)，大于 1 时上传也并发写入
+	ConcurrentRequests int
+	// 本次传输的带宽，字节/秒，为 0 时不限制，同时受 Host.BandwidthLimit 和 SetBandwidthLimit 的限制
+	BandwidthLimit int64
+	// 原子上传：先写入同目录下的 .文件名.随机后缀.scp-tmp，校验、设置权限和属主后重命名覆盖目标文件，
+	// 远程读取方不会看到写了一半的文件，需要服务端支持 posix-rename@openssh.com。
+	// 失败时删除临时文件；同时设置 Resume 时临时文件名固定为 .文件名.scp-tmp，传输中断时保留以便续传
+	Atomic bool
+	// 原子上传时备份目标文件原来的版本为 目标文件+BackupSuffix，为空时不备份
+	BackupSuffix string
+}
+
+// 最后一个非空的选项，没有时使用默认值
+func scpOptions(opts []*ScpOptions) *ScpOptions {
+	o := &ScpOptions{}
+	for _, opt := range opts {
+		if opt != nil {
+			o = opt
+		}
+	}
+	return o
+}
+
+// 非默认的 sftp 客户端参数，为空时复用连接池中的 sftp 客户端
+func (o *ScpOptions) clientOptions() []sftp.ClientOption {
+	var options []sftp.ClientOption
+	if o.PacketSize > 0 {
+		options = append(options, sftp.MaxPacketUnchecked(o.PacketSize))
+	}
+	if o.PacketSize > maxPacket {
+		// 服务端单次读取的数据可能少于请求的大小，并发读取时会出错，只能按顺序读取
+		options = append(options, sftp.UseConcurrentReads(false))
+	}
+	if o.ConcurrentRequests > 0 {
+		options = append(options, sftp.MaxConcurrentRequestsPerFile(o.ConcurrentRequests), sftp.UseConcurrentWrites(o.ConcurrentRequests > 1))
+	}
+	return options
+}
+
+func ScpPut(h *Host, cfg ssh.Config, localPath, remotePath string, opts ...*ScpOptions) error {
+	return ScpPutContext(context.Background(), h, cfg, localPath, remotePath, opts...)
+}
+
+// ctx 取消时中断传输并返回 ctx.Err()
+func ScpPutContext(ctx context.Context, h *Host, cfg ssh.Config, localPath, remotePath string, opts ...*ScpOptions) error {
+	o := scpOptions(opts)
+	conn, client, release, err := openClients(ctx, h, cfg, o.clientOptions()...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t, err := newScpTransfer(ctx, h, conn, client, remotePath, o)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-	return putFile(client, localPath, remotePath)
+	start := time.Now()
+	err = t.scan(func() (int, int64, error) {
+		return t.scanLocal(localPath, localPath)
+	})
+	if err == nil {
+		err = t.putFile(localPath, remotePath)
+	}
+	err = t.finish(err)
+	t.audit(h, AuditPut, localPath+" -> "+remotePath, start, err)
+	return err
+}
+
+// 一次 ScpPut、ScpGet 调用的传输状态
+type scpTransfer struct {
+	ctx    context.Context
+	host   *Host
+	conn   *ssh.Client
+	client *sftp.Client
+	opts   *ScpOptions
+	// 目标根目录，目录中的内容按相对于它的路径过滤
+	root   string
+	filter *scpFilter
+	// 远程校验命令的平台适配，第一次校验时确定
+	adapter     PlatformAdapter
+	adapterLock sync.Mutex
+	// 没有进度回调时为 nil
+	progress *progressTracker
+	// 依次传输时为 nil
+	pool     *transferPool
+	limiters []*bandwidthLimiter
+	// 结束后释放同一主机共享的带宽限制
+	releaseLimiters func()
+	// 目录属性在全部文件传输完成后设置
+	dirs []func() error
+	// 设置了 Include 时源目录中是否有要传输的内容，每个目录只遍历一次，只在遍历目录的协程中使用
+	matchedDirs map[string]bool
+	// 已传输的文件内容字节数，并发传输时原子更新
+	bytes int64
+}
+
+func newScpTransfer(ctx context.Context, h *Host, conn *ssh.Client, client *sftp.Client, root string, opts *ScpOptions) (*scpTransfer, error) {
+	filter, err := compileFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	t := &scpTransfer{
+		ctx:    ctx,
+		host:   h,
+		conn:   conn,
+		client: client,
+		opts:   opts,
+		root:   root,
+		filter: filter,
+		pool:   newTransferPool(ctx, opts.Concurrency),
+	}
+	t.limiters, t.releaseLimiters = transferLimiters(h, opts.BandwidthLimit)
+	if t.pool != nil {
+		// 一个文件失败后其余的传输也会中断
+		t.ctx = t.pool.ctx
+	}
+	if opts.OnProgress != nil {
+		t.progress = newProgressTracker(opts.OnProgress)
+	}
+	return t, nil
+}
+
+// 等待并发传输的文件完成，再设置目录属性，返回第一个错误
+func (t *scpTransfer) finish(err error) error {
+	poolErr := t.pool.wait()
+	t.releaseLimiters()
+	if poolErr != nil {
+		err = poolErr
+	}
+	if err != nil {
+		return err
+	}
+	for _, fn := range t.dirs {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func putFile(client *sftp.Client, localPath, remotePath string) error {
+// 按全部带宽限制等待
+func (t *scpTransfer) throttle(n int) error {
+	for _, limiter := range t.limiters {
+		if err := limiter.wait(t.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 有进度回调时先统计总量
+func (t *scpTransfer) scan(scan func() (int, int64, error)) error {
+	if t.progress == nil {
+		return nil
+	}
+	files, bytes, err := scan()
+	if err != nil {
+		return err
+	}
+	t.progress.setTotal(files, bytes)
+	return nil
+}
+
+func (t *scpTransfer) audit(h *Host, action AuditAction, command string, start time.Time, err error) {
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+	}
+	emitAudit(h, &AuditEvent{
+		Action:    action,
+		Command:   command,
+		StartTime: start,
+		ExitCode:  exitCode,
+		Bytes:     atomic.LoadInt64(&t.bytes),
+	}, err)
+}
+
+func (t *scpTransfer) putFile(localPath, remotePath string) error {
 	info, err := os.Lstat(localPath)
 	if err != nil {
 		return err
 	}
 	if info.Mode()&os.ModeSymlink != 0 {
-		return putLinkFile(client, localPath, remotePath)
+		return t.putLinkFile(localPath, remotePath)
 	}
 	if info.IsDir() {
-		return putDirectory(client, localPath, remotePath)
+		return t.putDirectory(localPath, remotePath, info)
 	}
-	return putLocalFile(client, localPath, remotePath, info)
+	return t.pool.do(func() error {
+		return t.putLocalFile(localPath, remotePath, info)
+	})
 }
 
-func putLocalFile(client *sftp.Client, localPath, remotePath string, info os.FileInfo) error {
-	localFile, err := os.Open(localPath)
+func (t *scpTransfer) putLocalFile(localPath, remotePath string, info os.FileInfo) error {
+	err := t.client.MkdirAll(filepath.Dir(remotePath))
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	defer localFile.Close()
-	err = client.MkdirAll(filepath.Dir(remotePath))
+	// 原子上传时传输、校验和设置属性都在临时文件上进行
+	writePath := remotePath
+	if t.opts.Atomic {
+		if remotePath, err = t.resolveRemoteLink(remotePath); err != nil {
+			log.Error(err)
+			return err
+		}
+		writePath, err = atomicTempPath(remotePath, t.opts.Resume)
+		if err != nil {
+			return err
+		}
+	}
+	var offset int64
+	if remoteInfo, err := t.client.Stat(writePath); err == nil {
+		offset = t.resumeOffset(remoteInfo, info)
+	}
+	file := t.progress.startFile(localPath, info.Size())
+	err = t.copyToRemote(localPath, writePath, info, offset, file)
+	if err == nil {
+		err = t.verifyFile(localPath, writePath, offset, func() error {
+			return t.copyToRemote(localPath, writePath, info, 0, file)
+		})
+	}
+	if err == nil {
+		err = t.preserveRemote(writePath, info)
+	}
+	if err == nil && t.opts.Atomic {
+		err = t.commitAtomic(writePath, remotePath)
+	}
+	if err != nil {
+		if t.opts.Atomic {
+			t.cleanupAtomic(writePath, err)
+		}
+		return err
+	}
+	t.progress.finishFile(file)
+	return nil
+}
+
+// 从 offset 处开始上传，offset 为 0 时覆盖远程文件
+func (t *scpTransfer) copyToRemote(localPath, remotePath string, info os.FileInfo, offset int64, file *fileProgress) error {
+	localFile, err := os.Open(localPath)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	remoteFile, err := client.Create(remotePath)
+	defer localFile.Close()
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	remoteFile, err := t.client.OpenFile(remotePath, flags)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 	defer remoteFile.Close()
-	err = client.Chmod(remoteFile.Name(), info.Mode())
+	err = t.client.Chmod(remoteFile.Name(), info.Mode())
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	size, err := io.Copy(remoteFile, localFile)
+	if offset > 0 {
+		if _, err = localFile.Seek(offset, io.SeekStart); err == nil {
+			_, err = remoteFile.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Debugf("resume put file %s -> %s from %d", localPath, remotePath, offset)
+	}
+	t.progress.seek(file, offset)
+	// 已知大小时 sftp 才会并发写入
+	reader := &io.LimitedReader{R: &contextReader{t: t, r: localFile, file: file}, N: info.Size() - offset}
+	size, err := io.Copy(remoteFile, reader)
+	atomic.AddInt64(&t.bytes, size)
 	log.Debugf("put file %s -> %s %d", localPath, remotePath, size)
 	if err != nil {
 		log.Error(err)
+		if t.opts.ConcurrentRequests > 1 {
+			// 并发写入失败时后面的数据可能已经写入，截断到连续写入的位置(失败后的文件偏移)，避免续传时留下空洞
+			if pos, err := remoteFile.Seek(0, io.SeekCurrent); err == nil {
+				_ = remoteFile.Truncate(pos)
+			}
+		}
 		return err
 	}
-	return nil
+	if t.opts.Atomic {
+		if err := t.syncRemote(remoteFile); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	// 校验前确保数据已写入
+	return remoteFile.Close()
 }
 
-func putLinkFile(client *sftp.Client, localPath, remotePath string) error {
+func (t *scpTransfer) putLinkFile(localPath, remotePath string) error {
 	readLocal, err := os.Readlink(localPath)
 	if err != nil {
 		return err
 	}
-	return putFile(client, readLocal, remotePath)
+	if t.opts.Preserve {
+		log.Debugf("put link %s -> %s", remotePath, readLocal)
+		return t.putSymlink(readLocal, remotePath)
+	}
+	// 相对路径的链接相对于链接所在的目录
+	if !filepath.IsAbs(readLocal) {
+		readLocal = filepath.Join(filepath.Dir(localPath), readLocal)
+	}
+	return t.putFile(readLocal, remotePath)
 }
 
-func putDirectory(client *sftp.Client, localPath, remotePath string) error {
+func (t *scpTransfer) putDirectory(localPath, remotePath string, info os.FileInfo) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	// 空目录也要创建
+	if err := t.client.MkdirAll(remotePath); err != nil {
+		log.Error(err)
+		return err
+	}
 	contents, err := ioutil.ReadDir(localPath)
 	if err != nil {
 		log.Error(err)
@@ -92,53 +373,139 @@ func putDirectory(client *sftp.Client, localPath, remotePath string) error {
 	for _, content := range contents {
 		src := filepath.Join(localPath, content.Name())
 		dst := filepath.Join(remotePath, content.Name())
-		err := putFile(client, src, dst)
+		rel, child := relPath(t.root, dst), t.followLink(content, src, os.Stat)
+		if !t.filter.match(rel, child) {
+			log.Debugf("skip %s", src)
+			continue
+		}
+		if child.IsDir() {
+			ok, err := t.dirMatches(rel, src, ioutil.ReadDir, os.Stat)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			if !ok {
+				log.Debugf("skip %s, no included files", src)
+				continue
+			}
+		}
+		err := t.putFile(src, dst)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
 	}
+	t.dirs = append(t.dirs, func() error {
+		return t.preserveRemote(remotePath, info)
+	})
 	return nil
 }
 
-func ScpGet(h *Host, cfg ssh.Config, localPath, remotePath string) error {
-	client, err := NewSftpClient(h, cfg)
+func ScpGet(h *Host, cfg ssh.Config, localPath, remotePath string, opts ...*ScpOptions) error {
+	return ScpGetContext(context.Background(), h, cfg, localPath, remotePath, opts...)
+}
+
+// ctx 取消时中断传输并返回 ctx.Err()
+func ScpGetContext(ctx context.Context, h *Host, cfg ssh.Config, localPath, remotePath string, opts ...*ScpOptions) error {
+	o := scpOptions(opts)
+	conn, client, release, err := openClients(ctx, h, cfg, o.clientOptions()...)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	t, err := newScpTransfer(ctx, h, conn, client, localPath, o)
 	if err != nil {
 		return err
 	}
-	defer client.Close()
-	return getFile(client, localPath, remotePath)
+	start := time.Now()
+	err = t.scan(func() (int, int64, error) {
+		return t.scanRemote(remotePath, remotePath)
+	})
+	if err == nil {
+		err = t.getFile(localPath, remotePath)
+	}
+	err = t.finish(err)
+	t.audit(h, AuditGet, remotePath+" -> "+localPath, start, err)
+	return err
 }
 
-func getFile(client *sftp.Client, localPath, remotePath string) error {
-	info, err := client.Lstat(remotePath)
+func (t *scpTransfer) getFile(localPath, remotePath string) error {
+	info, err := t.client.Lstat(remotePath)
 	if err != nil {
 		return err
 	}
 	if info.Mode()&os.ModeSymlink != 0 {
-		return getLinkFile(client, localPath, remotePath)
+		return t.getLinkFile(localPath, remotePath, info)
 	}
 	if info.IsDir() {
-		return getDirectory(client, localPath, remotePath)
+		return t.getDirectory(localPath, remotePath, info)
+	}
+	return t.pool.do(func() error {
+		return t.getRemoteFile(localPath, remotePath, info)
+	})
+}
+
+func (t *scpTransfer) getRemoteFile(localPath, remotePath string, info os.FileInfo) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	var offset int64
+	if localInfo, err := os.Stat(localPath); err == nil {
+		offset = t.resumeOffset(localInfo, info)
 	}
-	return getRemoteFile(client, localPath, remotePath, info)
+	file := t.progress.startFile(remotePath, info.Size())
+	err = t.copyFromRemote(localPath, remotePath, info, offset, file)
+	if err == nil {
+		err = t.verifyFile(localPath, remotePath, offset, func() error {
+			return t.copyFromRemote(localPath, remotePath, info, 0, file)
+		})
+	}
+	if err == nil {
+		err = t.preserveLocal(localPath, info)
+	}
+	if err != nil {
+		return err
+	}
+	t.progress.finishFile(file)
+	return nil
 }
 
-func getRemoteFile(client *sftp.Client, localPath, remotePath string, info os.FileInfo) error {
-	remoteFile, err := client.Open(remotePath)
+// 从 offset 处开始下载，offset 为 0 时覆盖本地文件
+func (t *scpTransfer) copyFromRemote(localPath, remotePath string, info os.FileInfo, offset int64, file *fileProgress) error {
+	remoteFile, err := t.client.Open(remotePath)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 	defer remoteFile.Close()
-	localFile, err := os.Create(localPath)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY
+	}
+	localFile, err := os.OpenFile(localPath, flags, 0666)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 	defer localFile.Close()
+	if offset > 0 {
+		if _, err = remoteFile.Seek(offset, io.SeekStart); err == nil {
+			_, err = localFile.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Debugf("resume get file %s -> %s from %d", remotePath, localPath, offset)
+	}
 
-	size, err := io.Copy(localFile, remoteFile)
+	t.progress.seek(file, offset)
+	// WriteTo 按 ConcurrentRequests 并发读取，按顺序写入本地文件
+	size, err := remoteFile.WriteTo(&contextWriter{t: t, w: localFile, file: file})
+	atomic.AddInt64(&t.bytes, size)
 	log.Debugf("get file %s -> %s %d", remotePath, localPath, size)
 	if err != nil {
 		log.Error(err)
@@ -146,19 +513,38 @@ func getRemoteFile(client *sftp.Client, localPath, remotePath string, info os.Fi
 	}
 
 	err = os.Chmod(localPath, info.Mode())
-	return err
+	if err != nil {
+		return err
+	}
+	return localFile.Close()
 }
 
-func getLinkFile(client *sftp.Client, localPath, remotePath string) error {
-	readRemote, err := client.ReadLink(remotePath)
+func (t *scpTransfer) getLinkFile(localPath, remotePath string, info os.FileInfo) error {
+	readRemote, err := t.client.ReadLink(remotePath)
 	if err != nil {
 		return err
 	}
-	return getFile(client, localPath, readRemote)
+	if t.opts.Preserve {
+		log.Debugf("get link %s -> %s", localPath, readRemote)
+		return t.getSymlink(readRemote, localPath, info)
+	}
+	// 相对路径的链接相对于链接所在的目录
+	if !filepath.IsAbs(readRemote) {
+		readRemote = filepath.Join(filepath.Dir(remotePath), readRemote)
+	}
+	return t.getFile(localPath, readRemote)
 }
 
-func getDirectory(client *sftp.Client, localPath, remotePath string) error {
-	contents, err := client.ReadDir(remotePath)
+func (t *scpTransfer) getDirectory(localPath, remotePath string, info os.FileInfo) error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	// 空目录也要创建
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		log.Error(err)
+		return err
+	}
+	contents, err := t.client.ReadDir(remotePath)
 	if err != nil {
 		log.Error(err)
 		return err
@@ -166,11 +552,68 @@ func getDirectory(client *sftp.Client, localPath, remotePath string) error {
 	for _, content := range contents {
 		src := filepath.Join(remotePath, content.Name())
 		dst := filepath.Join(localPath, content.Name())
-		err := getFile(client, dst, src)
+		rel, child := relPath(t.root, dst), t.followLink(content, src, t.client.Stat)
+		if !t.filter.match(rel, child) {
+			log.Debugf("skip %s", src)
+			continue
+		}
+		if child.IsDir() {
+			ok, err := t.dirMatches(rel, src, t.client.ReadDir, t.client.Stat)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			if !ok {
+				log.Debugf("skip %s, no included files", src)
+				continue
+			}
+		}
+		err := t.getFile(dst, src)
 		if err != nil {
 			log.Error(err)
 			return err
 		}
 	}
+	t.dirs = append(t.dirs, func() error {
+		return t.preserveLocal(localPath, info)
+	})
 	return nil
 }
+
+// 每次读取前检查 ctx，取消后传输在下一个数据包处中断，同时更新进度和限速
+type contextReader struct {
+	t    *scpTransfer
+	r    io.Reader
+	file *fileProgress
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	c.t.progress.add(c.file, int64(n))
+	if err == nil {
+		err = c.t.throttle(n)
+	}
+	return n, err
+}
+
+// 下载时使用，和 contextReader 一样在每次写入前检查 ctx
+type contextWriter struct {
+	t    *scpTransfer
+	w    io.Writer
+	file *fileProgress
+}
+
+func (c *contextWriter) Write(p []byte) (int, error) {
+	if err := c.t.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if err := c.t.throttle(len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	c.t.progress.add(c.file, int64(n))
+	return n, err
+}
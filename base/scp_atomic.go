@@ -0,0 +1,154 @@
+package base
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// 原子写入时的临时文件名后缀
+const atomicTempSuffix = ".scp-tmp"
+
+// 原子写入的临时文件，和目标在同一目录下才能重命名覆盖。
+// 续传时名称固定以便下次找到，否则加上随机后缀，避免同时上传同一个文件时互相覆盖
+func atomicTempPath(remotePath string, resume bool) (string, error) {
+	name := "." + filepath.Base(remotePath)
+	if !resume {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		name += "." + hex.EncodeToString(b)
+	}
+	return filepath.Join(filepath.Dir(remotePath), name+atomicTempSuffix), nil
+}
+
+// 上传失败时删除临时文件，续传时只保留传输中断的临时文件，校验失败的不能再续传
+func (t *scpTransfer) cleanupAtomic(tempPath string, err error) {
+	var mismatch *ChecksumMismatchError
+	if t.opts.Resume && !errors.As(err, &mismatch) {
+		return
+	}
+	if err := t.client.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		log.Warnf("remove temp file %s failed: %v", tempPath, err)
+	}
+}
+
+// 把临时文件刷到磁盘，服务端不支持 fsync@openssh.com 时跳过
+func (t *scpTransfer) syncRemote(remoteFile *sftp.File) error {
+	if _, ok := t.client.HasExtension("fsync@openssh.com"); !ok {
+		log.Debugf("fsync is not supported, skip %s", remoteFile.Name())
+		return nil
+	}
+	return remoteFile.Sync()
+}
+
+// 链接最多解析的层数，与 Linux 的 ELOOP 限制一致
+const maxLinkDepth = 40
+
+// 目标文件是链接时替换链接指向的文件，与非原子上传写入链接指向的文件一致
+func (t *scpTransfer) resolveRemoteLink(remotePath string) (string, error) {
+	for i := 0; i < maxLinkDepth; i++ {
+		info, err := t.client.Lstat(remotePath)
+		if os.IsNotExist(err) {
+			return remotePath, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return remotePath, nil
+		}
+		target, err := t.client.ReadLink(remotePath)
+		if err != nil {
+			return "", err
+		}
+		// 相对路径的链接相对于链接所在的目录
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(remotePath), target)
+		}
+		remotePath = target
+	}
+	return "", fmt.Errorf("too many levels of symbolic links: %s", remotePath)
+}
+
+// 用校验过的临时文件替换目标文件，目标文件已存在时沿用其属主，需要时先备份
+func (t *scpTransfer) commitAtomic(tempPath, remotePath string) error {
+	old, err := t.client.Lstat(remotePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	moved := false
+	if old != nil {
+		t.keepOwner(tempPath, old)
+		if t.opts.BackupSuffix != "" {
+			if moved, err = t.backupRemote(remotePath); err != nil {
+				return err
+			}
+		}
+	}
+	if err := t.client.PosixRename(tempPath, remotePath); err != nil {
+		if moved {
+			// 备份时目标文件被改名，替换失败时放回原处
+			backupPath := remotePath + t.opts.BackupSuffix
+			if err := t.client.PosixRename(backupPath, remotePath); err != nil {
+				log.Errorf("restore %s from %s failed: %v", remotePath, backupPath, err)
+			}
+		}
+		return fmt.Errorf("rename %s to %s: %w", tempPath, remotePath, err)
+	}
+	log.Debugf("atomic put %s", remotePath)
+	return nil
+}
+
+// 没有保留本地属主时，替换后的文件沿用原文件的属主，没有权限修改时只记录日志
+func (t *scpTransfer) keepOwner(tempPath string, old os.FileInfo) {
+	if t.opts.Preserve && t.opts.PreserveOwner {
+		return
+	}
+	oldStat, ok := old.Sys().(*sftp.FileStat)
+	if !ok {
+		return
+	}
+	info, err := t.client.Stat(tempPath)
+	if err != nil {
+		return
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok && stat.UID == oldStat.UID && stat.GID == oldStat.GID {
+		return
+	}
+	if err := t.client.Chown(tempPath, int(oldStat.UID), int(oldStat.GID)); err != nil {
+		log.Warnf("keep owner %d:%d of %s failed: %v", oldStat.UID, oldStat.GID, tempPath, err)
+		return
+	}
+	// chown 会清除 setuid 位，重新设置权限
+	if err := t.client.Chmod(tempPath, info.Mode()&preserveMode); err != nil {
+		log.Warnf("chmod %s failed: %v", tempPath, err)
+	}
+}
+
+// 备份为 目标文件+BackupSuffix，优先使用硬链接，替换前目标文件一直存在。
+// 不支持硬链接时改名，moved 为 true，替换失败时需要改回
+func (t *scpTransfer) backupRemote(remotePath string) (moved bool, err error) {
+	backupPath := remotePath + t.opts.BackupSuffix
+	if _, err := t.client.Lstat(backupPath); err == nil {
+		if err := t.client.Remove(backupPath); err != nil {
+			return false, err
+		}
+	}
+	err = t.client.Link(remotePath, backupPath)
+	if err == nil {
+		return false, nil
+	}
+	// 替换完成前目标文件会短暂不存在
+	log.Warnf("link %s to %s failed, rename instead: %v", remotePath, backupPath, err)
+	if err := t.client.PosixRename(remotePath, backupPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
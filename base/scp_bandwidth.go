@@ -0,0 +1,120 @@
+package base
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 带宽限制，共享同一个限制的传输总速度不超过 rate
+type bandwidthLimiter struct {
+	mutex sync.Mutex
+	// 字节/秒，小于等于 0 时不限制
+	rate int64
+	// 下一块数据可以发送的时间
+	next time.Time
+}
+
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+func (l *bandwidthLimiter) setRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = rate
+}
+
+// 为 n 字节预约发送时间，需要时等待，ctx 取消时返回 ctx.Err()
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return nil
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 同一主机正在进行的传输共享的带宽限制，最后一个传输结束时删除
+type hostLimiter struct {
+	*bandwidthLimiter
+	transfers int
+}
+
+var (
+	bandwidthLock   sync.Mutex
+	globalBandwidth *bandwidthLimiter
+	hostBandwidth   = map[string]*hostLimiter{}
+)
+
+// 限制所有主机所有传输的总带宽，字节/秒，为 0 时不限制
+func SetBandwidthLimit(bytesPerSecond int64) {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	if bytesPerSecond <= 0 {
+		globalBandwidth = nil
+		return
+	}
+	if globalBandwidth == nil {
+		globalBandwidth = newBandwidthLimiter(bytesPerSecond)
+		return
+	}
+	globalBandwidth.setRate(bytesPerSecond)
+}
+
+// 一次传输适用的带宽限制：本次传输、同一主机的全部传输和全局，传输结束后需要调用 release
+func transferLimiters(h *Host, rate int64) (limiters []*bandwidthLimiter, release func()) {
+	if rate > 0 {
+		limiters = append(limiters, newBandwidthLimiter(rate))
+	}
+	release = func() {}
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	if h.BandwidthLimit > 0 {
+		key := poolKey(h)
+		limiter, ok := hostBandwidth[key]
+		if !ok {
+			limiter = &hostLimiter{bandwidthLimiter: newBandwidthLimiter(h.BandwidthLimit)}
+			hostBandwidth[key] = limiter
+		} else {
+			// 以最近一次传输的配置为准
+			limiter.setRate(h.BandwidthLimit)
+		}
+		limiter.transfers++
+		limiters = append(limiters, limiter.bandwidthLimiter)
+		release = func() { releaseHostLimiter(key, limiter) }
+	}
+	if globalBandwidth != nil {
+		limiters = append(limiters, globalBandwidth)
+	}
+	return limiters, release
+}
+
+func releaseHostLimiter(key string, limiter *hostLimiter) {
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	limiter.transfers--
+	if limiter.transfers == 0 && hostBandwidth[key] == limiter {
+		delete(hostBandwidth, key)
+	}
+}
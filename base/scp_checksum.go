@@ -0,0 +1,140 @@
+package base
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"os"
+)
+
+// 传输后本地和远程文件的校验值不一致
+type ChecksumMismatchError struct {
+	LocalPath  string
+	RemotePath string
+	Algorithm  ChecksumAlgorithm
+	Local      string
+	Remote     string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: local %s is %s, remote %s is %s",
+		e.Algorithm, e.LocalPath, e.Local, e.RemotePath, e.Remote)
+}
+
+// 断点续传的起始位置，目标文件比源文件小时从目标文件的大小处继续，否则重新传输。
+// 大小相同时认为已传输完成，需要校验和一致，没有设置 Checksum 时需要修改时间一致
+func (t *scpTransfer) resumeOffset(dst os.FileInfo, src os.FileInfo) int64 {
+	if !t.opts.Resume || !dst.Mode().IsRegular() || dst.Size() > src.Size() {
+		return 0
+	}
+	// 有 Checksum 时由 verifyFile 校验，不一致会重新传输
+	if dst.Size() == src.Size() && t.opts.Checksum == "" && dst.ModTime().Unix() != src.ModTime().Unix() {
+		return 0
+	}
+	return dst.Size()
+}
+
+// 校验传输结果，续传的文件校验失败时说明已有部分与源文件不同，用 retransfer 完整传输一次后再校验
+func (t *scpTransfer) verifyFile(localPath, remotePath string, offset int64, retransfer func() error) error {
+	if t.opts.Checksum == "" {
+		return nil
+	}
+	err := t.compareChecksum(localPath, remotePath)
+	var mismatch *ChecksumMismatchError
+	if offset == 0 || !errors.As(err, &mismatch) {
+		return err
+	}
+	log.Warnf("resumed transfer of %s is corrupted, transfer again: %v", remotePath, err)
+	if err := retransfer(); err != nil {
+		return err
+	}
+	return t.compareChecksum(localPath, remotePath)
+}
+
+func (t *scpTransfer) compareChecksum(localPath, remotePath string) error {
+	algorithm := t.opts.Checksum
+	local, err := localChecksum(localPath, algorithm)
+	if err != nil {
+		return err
+	}
+	remote, err := t.remoteChecksum(remotePath)
+	if err != nil {
+		return err
+	}
+	if local != remote {
+		return &ChecksumMismatchError{
+			LocalPath:  localPath,
+			RemotePath: remotePath,
+			Algorithm:  algorithm,
+			Local:      local,
+			Remote:     remote,
+		}
+	}
+	log.Debugf("%s checksum of %s verified: %s", algorithm, remotePath, local)
+	return nil
+}
+
+// 在远程主机上执行校验命令
+func (t *scpTransfer) remoteChecksum(remotePath string) (string, error) {
+	adapter, err := t.platformAdapter()
+	if err != nil {
+		return "", err
+	}
+	result, err := runCommand(t.ctx, t.conn, t.host, adapter.ChecksumCmd(remotePath, t.opts.Checksum))
+	if err != nil {
+		return "", err
+	}
+	return parseChecksum(result.Stdout, t.opts.Checksum)
+}
+
+// 第一次校验时确定远程平台，Host.Platform 为空时先识别平台，并发传输时只识别一次
+func (t *scpTransfer) platformAdapter() (PlatformAdapter, error) {
+	t.adapterLock.Lock()
+	defer t.adapterLock.Unlock()
+	if t.adapter != nil {
+		return t.adapter, nil
+	}
+	platform := t.host.Platform
+	if platform == "" {
+		result, err := runCommand(t.ctx, t.conn, t.host, "uname -s")
+		if err != nil {
+			return nil, err
+		}
+		platform, err = parsePlatform(result.Stdout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	adapter, err := NewPlatformAdapter(platform)
+	if err != nil {
+		return nil, err
+	}
+	t.adapter = adapter
+	return adapter, nil
+}
+
+func localChecksum(path string, algorithm ChecksumAlgorithm) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case MD5Checksum:
+		h = md5.New()
+	case SHA256Checksum:
+		h = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
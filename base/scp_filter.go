@@ -0,0 +1,258 @@
+package base
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 目录传输的过滤规则，只作用于目录中的内容，传输单个文件时不过滤
+// 规则为 gitignore 语法：支持 * ? [...] 和 **，以 / 结尾只匹配目录，
+// 以 / 开头或中间含有 / 时相对传输根目录匹配，否则匹配任意一级的名称
+type ScpFilter struct {
+	// 只传输匹配的文件，匹配的目录中的全部文件都会传输，为空时不限制，
+	// 没有任何匹配文件的目录不会创建
+	Include []string `json:"include"`
+	// 跳过匹配的文件和目录，以 ! 开头的规则重新包含前面排除的路径，后面的规则优先
+	Exclude []string `json:"exclude"`
+	// 最大深度，根目录下的内容深度为 1，为 0 时不限制
+	MaxDepth int `json:"maxDepth"`
+	// 文件大小范围，为 0 时不限制
+	MinSize int64 `json:"minSize"`
+	MaxSize int64 `json:"maxSize"`
+}
+
+type filterRule struct {
+	re      *regexp.Regexp
+	dirOnly bool
+	negate  bool
+}
+
+func (r *filterRule) match(rel string, isDir bool) bool {
+	return (!r.dirOnly || isDir) && r.re.MatchString(rel)
+}
+
+// 编译后的过滤规则，为 nil 时不过滤
+type scpFilter struct {
+	*ScpFilter
+	include []*filterRule
+	exclude []*filterRule
+}
+
+func compileFilter(f *ScpFilter) (*scpFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	c := &scpFilter{ScpFilter: f}
+	for _, pattern := range f.Include {
+		rule, err := compileRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			c.include = append(c.include, rule)
+		}
+	}
+	for _, pattern := range f.Exclude {
+		rule, err := compileRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			c.exclude = append(c.exclude, rule)
+		}
+	}
+	return c, nil
+}
+
+// 空规则和 # 开头的注释返回 nil
+func compileRule(pattern string) (*filterRule, error) {
+	rule := &filterRule{}
+	p := strings.TrimSpace(pattern)
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil, nil
+	}
+	if strings.HasPrefix(p, "!") {
+		rule.negate, p = true, p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly, p = true, strings.TrimRight(p, "/")
+	}
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return nil, fmt.Errorf("invalid filter pattern %q", pattern)
+	}
+	expr := globExpr(p)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "(?:^|/)" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter pattern %q: %v", pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+// 把 glob 转换为正则表达式，* 和 ? 不匹配 /，** 匹配任意多级目录
+func globExpr(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				switch {
+				case i+2 == len(p):
+					// a/** 匹配 a 中的全部内容
+					b.WriteString(".*")
+				case p[i+2] == '/' && (i == 0 || p[i-1] == '/'):
+					// **/ 匹配零到多级目录
+					b.WriteString("(?:.*/)?")
+					i++
+				default:
+					b.WriteString(".*")
+				}
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(p) {
+				i++
+				b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// 判断是否传输，rel 为相对于传输根目录的路径，使用 / 分隔，info 为链接指向的文件
+func (f *scpFilter) match(rel string, info os.FileInfo) bool {
+	if f == nil || rel == "" {
+		return true
+	}
+	if f.MaxDepth > 0 && strings.Count(rel, "/")+1 > f.MaxDepth {
+		return false
+	}
+	if f.excluded(rel, info.IsDir()) {
+		return false
+	}
+	if info.IsDir() {
+		// 被排除的目录不再遍历，其他目录需要遍历后才知道是否有包含的文件
+		return true
+	}
+	if f.MinSize > 0 && info.Size() < f.MinSize || f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return false
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	// 文件本身或所在的某一级目录匹配即包含
+	for i := 0; i <= len(rel); i++ {
+		if i < len(rel) && rel[i] != '/' {
+			continue
+		}
+		for _, rule := range f.include {
+			if rule.match(rel[:i], i < len(rel)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 最后一条匹配的规则决定是否排除
+func (f *scpFilter) excluded(rel string, isDir bool) bool {
+	excluded := false
+	for _, rule := range f.exclude {
+		if rule.match(rel, isDir) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+// path 相对于 root 的路径，使用 / 分隔，root 本身为空
+func relPath(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// 设置了 Include 时不创建空目录
+func (f *scpFilter) pruneDirs() bool {
+	return f != nil && len(f.include) > 0
+}
+
+// 目录中是否有要传输的内容，没有设置 Include 时总是传输。
+// 结果按目录缓存，遍历子目录时不再重复读取
+func (t *scpTransfer) dirMatches(rel, dir string, readDir func(string) ([]os.FileInfo, error), stat func(string) (os.FileInfo, error)) (bool, error) {
+	if !t.filter.pruneDirs() {
+		return true, nil
+	}
+	if matched, ok := t.matchedDirs[dir]; ok {
+		return matched, nil
+	}
+	contents, err := readDir(dir)
+	if err != nil {
+		return false, err
+	}
+	matched := false
+	for _, content := range contents {
+		name, p := path.Join(rel, content.Name()), filepath.Join(dir, content.Name())
+		info := t.followLink(content, p, stat)
+		if !t.filter.match(name, info) {
+			continue
+		}
+		if !info.IsDir() {
+			matched = true
+			break
+		}
+		if matched, err = t.dirMatches(name, p, readDir, stat); err != nil {
+			return false, err
+		}
+		if matched {
+			break
+		}
+	}
+	if t.matchedDirs == nil {
+		t.matchedDirs = make(map[string]bool)
+	}
+	t.matchedDirs[dir] = matched
+	return matched, nil
+}
+
+// 目录中的链接按指向的文件过滤，保留模式或链接失效时按链接本身过滤
+func (t *scpTransfer) followLink(info os.FileInfo, path string, stat func(string) (os.FileInfo, error)) os.FileInfo {
+	if t.opts.Preserve || info.Mode()&os.ModeSymlink == 0 {
+		return info
+	}
+	if target, err := stat(path); err == nil {
+		return target
+	}
+	return info
+}
@@ -0,0 +1,83 @@
+package base
+
+import (
+	"github.com/pkg/sftp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 保留的权限位
+const preserveMode = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// 上传后按本地文件设置远程的属主、权限和时间，远程链接只重建不设置属性
+func (t *scpTransfer) preserveRemote(remotePath string, info os.FileInfo) error {
+	if !t.opts.Preserve {
+		return nil
+	}
+	// 先改属主，chown 会清除 setuid 位
+	if t.opts.PreserveOwner {
+		if uid, gid, ok := fileOwner(info); ok {
+			if err := t.client.Chown(remotePath, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	if err := t.client.Chmod(remotePath, info.Mode()&preserveMode); err != nil {
+		return err
+	}
+	return t.client.Chtimes(remotePath, fileAtime(info), info.ModTime())
+}
+
+// 下载后按远程文件设置本地的属主、权限和时间
+func (t *scpTransfer) preserveLocal(localPath string, info os.FileInfo) error {
+	if !t.opts.Preserve {
+		return nil
+	}
+	stat, _ := info.Sys().(*sftp.FileStat)
+	if t.opts.PreserveOwner && stat != nil {
+		if err := os.Chown(localPath, int(stat.UID), int(stat.GID)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(localPath, info.Mode()&preserveMode); err != nil {
+		return err
+	}
+	atime := info.ModTime()
+	if stat != nil {
+		atime = time.Unix(int64(stat.Atime), 0)
+	}
+	return os.Chtimes(localPath, atime, info.ModTime())
+}
+
+// 在远程重建链接，已有的文件或链接会被替换
+func (t *scpTransfer) putSymlink(target, remotePath string) error {
+	if err := t.client.MkdirAll(filepath.Dir(remotePath)); err != nil {
+		return err
+	}
+	if _, err := t.client.Lstat(remotePath); err == nil {
+		if err := t.client.Remove(remotePath); err != nil {
+			return err
+		}
+	}
+	return t.client.Symlink(target, remotePath)
+}
+
+// 在本地重建链接，远程链接的属主只在本地设置
+func (t *scpTransfer) getSymlink(target, localPath string, info os.FileInfo) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(localPath); err == nil {
+		if err := os.Remove(localPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink(target, localPath); err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok && t.opts.PreserveOwner {
+		return os.Lchown(localPath, int(stat.UID), int(stat.GID))
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package base
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// 本地文件的访问时间，取不到时使用修改时间
+func fileAtime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+	}
+	return info.ModTime()
+}
+
+// 本地文件的属主和属组
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
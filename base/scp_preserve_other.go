@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package base
+
+import (
+	"os"
+	"time"
+)
+
+// 其他平台 Stat_t 中访问时间的字段名不同，使用修改时间
+func fileAtime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// 其他平台不保留本地文件的属主
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
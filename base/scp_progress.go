@@ -0,0 +1,201 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 两次进度回调的最小间隔，文件完成时总会回调
+const progressInterval = 200 * time.Millisecond
+
+// 传输进度
+type ScpProgress struct {
+	// 当前文件的源路径，并发传输时为触发本次回调的文件
+	File      string `json:"file"`
+	FileBytes int64  `json:"fileBytes"`
+	FileSize  int64  `json:"fileSize"`
+	// 全部文件，续传时已有的部分计入已完成
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"totalBytes"`
+	Files      int   `json:"files"`
+	TotalFiles int   `json:"totalFiles"`
+	// 本次实际传输的平均速度，字节/秒
+	Rate    float64       `json:"rate"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+type progressTracker struct {
+	mutex         sync.Mutex
+	callbackMutex sync.Mutex
+	onProgress    func(progress ScpProgress)
+	start         time.Time
+	last          time.Time
+	state         ScpProgress
+	// 生成的进度副本序号(由 mutex 保护)和已回调的序号(由 callbackMutex 保护)
+	seq      uint64
+	reported uint64
+	// 已完成文件的大小和正在传输的文件已有的字节数
+	doneBytes   int64
+	activeBytes int64
+	sent        int64
+}
+
+// 一个文件的传输进度，并发传输时每个文件各有一个
+type fileProgress struct {
+	name  string
+	size  int64
+	bytes int64
+}
+
+func newProgressTracker(onProgress func(progress ScpProgress)) *progressTracker {
+	return &progressTracker{onProgress: onProgress, start: time.Now()}
+}
+
+func (p *progressTracker) setTotal(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.state.TotalFiles, p.state.TotalBytes = files, bytes
+}
+
+func (p *progressTracker) startFile(file string, size int64) *fileProgress {
+	if p == nil {
+		return nil
+	}
+	return &fileProgress{name: file, size: size}
+}
+
+// 开始一次传输，offset 为续传时已有的大小，重新传输时为 0
+func (p *progressTracker) seek(f *fileProgress, offset int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.activeBytes += offset - f.bytes
+	f.bytes = offset
+	p.report(f, true)
+}
+
+func (p *progressTracker) add(f *fileProgress, n int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	f.bytes += n
+	p.activeBytes += n
+	p.sent += n
+	p.report(f, false)
+}
+
+func (p *progressTracker) finishFile(f *fileProgress) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.activeBytes -= f.bytes
+	p.doneBytes += f.size
+	f.bytes = f.size
+	p.state.Files++
+	p.report(f, true)
+}
+
+// 调用时持有 mutex，返回时已释放。回调使用进度的副本并在释放 mutex 后执行，回调较慢时不阻塞其它文件的计数；
+// 回调逐个执行，比已回调的进度更早的副本直接丢弃。回调中的当前文件为触发本次回调的文件
+func (p *progressTracker) report(f *fileProgress, force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.last) < progressInterval {
+		p.mutex.Unlock()
+		return
+	}
+	p.last = now
+	p.state.File, p.state.FileSize, p.state.FileBytes = f.name, f.size, f.bytes
+	p.state.Bytes = p.doneBytes + p.activeBytes
+	p.state.Elapsed = now.Sub(p.start)
+	if seconds := p.state.Elapsed.Seconds(); seconds > 0 {
+		p.state.Rate = float64(p.sent) / seconds
+	}
+	p.seq++
+	state, seq := p.state, p.seq
+	p.mutex.Unlock()
+
+	p.callbackMutex.Lock()
+	defer p.callbackMutex.Unlock()
+	if seq > p.reported {
+		p.reported = seq
+		p.onProgress(state)
+	}
+}
+
+// 统计本地待传输的文件数和总大小，链接按指向的文件计算，与 putFile 一致，保留模式下链接不计入
+func (t *scpTransfer) scanLocal(root, path string) (int, int64, error) {
+	stat := os.Stat
+	if t.opts.Preserve {
+		stat = os.Lstat
+	}
+	info, err := stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !t.filter.match(relPath(root, path), info) || info.Mode()&os.ModeSymlink != 0 {
+		return 0, 0, nil
+	}
+	if !info.IsDir() {
+		return 1, info.Size(), nil
+	}
+	contents, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		files int
+		bytes int64
+	)
+	for _, content := range contents {
+		n, size, err := t.scanLocal(root, filepath.Join(path, content.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		files += n
+		bytes += size
+	}
+	return files, bytes, nil
+}
+
+func (t *scpTransfer) scanRemote(root, path string) (int, int64, error) {
+	stat := t.client.Stat
+	if t.opts.Preserve {
+		stat = t.client.Lstat
+	}
+	info, err := stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !t.filter.match(relPath(root, path), info) || info.Mode()&os.ModeSymlink != 0 {
+		return 0, 0, nil
+	}
+	if !info.IsDir() {
+		return 1, info.Size(), nil
+	}
+	contents, err := t.client.ReadDir(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		files int
+		bytes int64
+	)
+	for _, content := range contents {
+		n, size, err := t.scanRemote(root, filepath.Join(path, content.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+		files += n
+		bytes += size
+	}
+	return files, bytes, nil
+}
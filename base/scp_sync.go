@@ -0,0 +1,441 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 同步选项
+type SyncOptions struct {
+	// 大小相同时比较校验值而不是修改时间，远程通过命令计算，为空时只比较大小和修改时间
+	Checksum ChecksumAlgorithm
+	// 删除目标中源没有的文件和目录
+	Delete bool
+	// 只生成同步计划，不修改目标
+	DryRun bool
+	// 进度回调，总量为需要传输的文件
+	OnProgress func(progress ScpProgress)
+	// 过滤规则同时作用于源和目标，目标中被排除的文件不会被删除
+	Filter *ScpFilter
+	// 同时传输的文件数和带宽限制，同 ScpOptions
+	Concurrency    int
+	BandwidthLimit int64
+}
+
+// 同步操作类型
+type SyncOp string
+
+const (
+	SyncCreate SyncOp = "create"
+	SyncUpdate SyncOp = "update"
+	SyncDelete SyncOp = "delete"
+)
+
+// 一项同步操作
+type SyncOperation struct {
+	Op SyncOp `json:"op"`
+	// 相对于同步根目录的路径，使用 / 分隔，根目录本身为空
+	Path  string `json:"path"`
+	IsDir bool   `json:"isDir"`
+	// 需要传输的字节数，目录和删除为 0
+	Size int64 `json:"size"`
+}
+
+func (o SyncOperation) String() string {
+	sign := map[SyncOp]string{SyncCreate: "+", SyncUpdate: "~", SyncDelete: "-"}[o.Op]
+	name := o.Path
+	if name == "" {
+		name = "."
+	}
+	if o.IsDir {
+		name += "/"
+	}
+	return sign + " " + name
+}
+
+// 同步结果，DryRun 时为同步计划
+type SyncResult struct {
+	DryRun     bool            `json:"dryRun"`
+	Operations []SyncOperation `json:"operations"`
+	Created    int             `json:"created"`
+	Updated    int             `json:"updated"`
+	Deleted    int             `json:"deleted"`
+	// 没有变化的文件数
+	Unchanged int `json:"unchanged"`
+	// 需要传输的字节数
+	Bytes int64 `json:"bytes"`
+}
+
+// 差异摘要，每行一项操作，最后一行为统计
+func (r *SyncResult) String() string {
+	var b strings.Builder
+	for _, op := range r.Operations {
+		b.WriteString(op.String())
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d created, %d updated, %d deleted, %d unchanged, %d bytes", r.Created, r.Updated, r.Deleted, r.Unchanged, r.Bytes)
+	if r.DryRun {
+		b.WriteString(" (dry run)")
+	}
+	return b.String()
+}
+
+// 把本地目录同步到远程，只传输大小、修改时间或校验值不同的文件
+func SyncPut(h *Host, cfg ssh.Config, localPath, remotePath string, opts *SyncOptions) (*SyncResult, error) {
+	return SyncPutContext(context.Background(), h, cfg, localPath, remotePath, opts)
+}
+
+func SyncPutContext(ctx context.Context, h *Host, cfg ssh.Config, localPath, remotePath string, opts *SyncOptions) (*SyncResult, error) {
+	return syncTree(ctx, h, cfg, localPath, remotePath, opts, true)
+}
+
+// 把远程目录同步到本地
+func SyncGet(h *Host, cfg ssh.Config, localPath, remotePath string, opts *SyncOptions) (*SyncResult, error) {
+	return SyncGetContext(context.Background(), h, cfg, localPath, remotePath, opts)
+}
+
+func SyncGetContext(ctx context.Context, h *Host, cfg ssh.Config, localPath, remotePath string, opts *SyncOptions) (*SyncResult, error) {
+	return syncTree(ctx, h, cfg, localPath, remotePath, opts, false)
+}
+
+// 一次同步的状态，put 为 true 时源为本地
+type syncTransfer struct {
+	*scpTransfer
+	localPath  string
+	remotePath string
+	put        bool
+	options    *SyncOptions
+	// 类型不同需要先删除的路径，其下的内容不再单独删除
+	replaced map[string]bool
+}
+
+func syncTree(ctx context.Context, h *Host, cfg ssh.Config, localPath, remotePath string, opts *SyncOptions, put bool) (*SyncResult, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	conn, client, release, err := openClients(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	t, err := newScpTransfer(ctx, h, conn, client, "", &ScpOptions{
+		Checksum:       opts.Checksum,
+		OnProgress:     opts.OnProgress,
+		Filter:         opts.Filter,
+		Concurrency:    opts.Concurrency,
+		BandwidthLimit: opts.BandwidthLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &syncTransfer{
+		scpTransfer: t,
+		localPath:   localPath,
+		remotePath:  remotePath,
+		put:         put,
+		options:     opts,
+		replaced:    map[string]bool{},
+	}
+	start := time.Now()
+	result, err := s.plan()
+	if err == nil && !opts.DryRun {
+		err = s.apply(result)
+	}
+	err = s.finish(err)
+	if opts.DryRun {
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("sync %s -> %s dry run:\n%s", s.src(), s.dst(), result)
+		return result, err
+	}
+	action, command := AuditPut, "sync "+localPath+" -> "+remotePath
+	if !put {
+		action, command = AuditGet, "sync "+remotePath+" -> "+localPath
+	}
+	s.audit(h, action, command, start, err)
+	return result, err
+}
+
+func (s *syncTransfer) src() string {
+	if s.put {
+		return s.localPath
+	}
+	return s.remotePath
+}
+
+func (s *syncTransfer) dst() string {
+	if s.put {
+		return s.remotePath
+	}
+	return s.localPath
+}
+
+// 列出目录树，键为相对路径，链接按指向的文件处理，与 putFile 一致，不存在时返回空
+func (s *syncTransfer) listTree(local bool, root string) (map[string]os.FileInfo, error) {
+	stat, readDir := os.Stat, ioutil.ReadDir
+	if !local {
+		stat, readDir = s.client.Stat, s.client.ReadDir
+	}
+	tree := map[string]os.FileInfo{}
+	info, err := stat(root)
+	if os.IsNotExist(err) {
+		return tree, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tree[""] = info
+	// 返回加入的数量，设置了 Include 时去掉没有匹配文件的目录
+	var walk func(rel string) (int, error)
+	walk = func(rel string) (int, error) {
+		if err := s.ctx.Err(); err != nil {
+			return 0, err
+		}
+		contents, err := readDir(filepath.Join(root, rel))
+		if err != nil {
+			return 0, err
+		}
+		added := 0
+		for _, content := range contents {
+			name := path.Join(rel, content.Name())
+			if content.Mode()&os.ModeSymlink != 0 {
+				if content, err = stat(filepath.Join(root, name)); err != nil {
+					log.Warnf("skip broken link %s: %v", filepath.Join(root, name), err)
+					continue
+				}
+			}
+			if !s.filter.match(name, content) {
+				continue
+			}
+			tree[name] = content
+			if content.IsDir() {
+				n, err := walk(name)
+				if err != nil {
+					return 0, err
+				}
+				if n == 0 && s.filter.pruneDirs() {
+					delete(tree, name)
+					continue
+				}
+				added += n
+			}
+			added++
+		}
+		return added, nil
+	}
+	if info.IsDir() {
+		if _, err := walk(""); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// 比较两边的目录树生成同步计划
+func (s *syncTransfer) plan() (*SyncResult, error) {
+	srcTree, err := s.listTree(s.put, s.src())
+	if err != nil {
+		return nil, err
+	}
+	if len(srcTree) == 0 {
+		return nil, &os.PathError{Op: "sync", Path: s.src(), Err: os.ErrNotExist}
+	}
+	dstTree, err := s.listTree(!s.put, s.dst())
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SyncResult{DryRun: s.options.DryRun}
+	for _, name := range sortedKeys(srcTree) {
+		src := srcTree[name]
+		dst, ok := dstTree[name]
+		op := SyncOperation{Op: SyncCreate, Path: name, IsDir: src.IsDir()}
+		if ok {
+			if src.IsDir() != dst.IsDir() {
+				s.replaced[name] = true
+				op.Op = SyncUpdate
+			} else if src.IsDir() {
+				continue
+			} else if changed, err := s.changed(name, src, dst); err != nil {
+				return nil, err
+			} else if !changed {
+				result.Unchanged++
+				continue
+			} else {
+				op.Op = SyncUpdate
+			}
+		}
+		if !src.IsDir() {
+			op.Size = src.Size()
+		}
+		result.add(op)
+	}
+	if s.options.Delete {
+		deleted := map[string]bool{}
+		for _, name := range sortedKeys(dstTree) {
+			if _, ok := srcTree[name]; ok || underAny(name, s.replaced) || underAny(name, deleted) {
+				continue
+			}
+			deleted[name] = true
+			result.add(SyncOperation{Op: SyncDelete, Path: name, IsDir: dstTree[name].IsDir()})
+		}
+	}
+	return result, nil
+}
+
+func (r *SyncResult) add(op SyncOperation) {
+	r.Operations = append(r.Operations, op)
+	r.Bytes += op.Size
+	switch op.Op {
+	case SyncCreate:
+		r.Created++
+	case SyncUpdate:
+		r.Updated++
+	case SyncDelete:
+		r.Deleted++
+	}
+}
+
+// 大小不同即有变化，大小相同时按选项比较校验值或修改时间(sftp 只精确到秒)
+func (s *syncTransfer) changed(name string, src, dst os.FileInfo) (bool, error) {
+	if src.Size() != dst.Size() {
+		return true, nil
+	}
+	if s.options.Checksum == "" {
+		return !src.ModTime().Truncate(time.Second).Equal(dst.ModTime().Truncate(time.Second)), nil
+	}
+	err := s.compareChecksum(s.localFile(name), s.remoteFile(name))
+	var mismatch *ChecksumMismatchError
+	if errors.As(err, &mismatch) {
+		return true, nil
+	}
+	return false, err
+}
+
+func (s *syncTransfer) localFile(name string) string {
+	return filepath.Join(s.localPath, filepath.FromSlash(name))
+}
+
+func (s *syncTransfer) remoteFile(name string) string {
+	return path.Join(s.remotePath, name)
+}
+
+// 按计划修改目标，先创建和更新，最后删除多余的文件，传输的文件保留源的修改时间
+func (s *syncTransfer) apply(result *SyncResult) error {
+	files, bytes := 0, int64(0)
+	for _, op := range result.Operations {
+		if op.Op != SyncDelete && !op.IsDir {
+			files++
+			bytes += op.Size
+		}
+	}
+	s.progress.setTotal(files, bytes)
+
+	for _, op := range result.Operations {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		if op.Op == SyncDelete {
+			continue
+		}
+		if s.replaced[op.Path] {
+			if err := s.remove(op.Path); err != nil {
+				return err
+			}
+		}
+		var err error
+		if op.IsDir {
+			err = s.mkdir(op.Path)
+		} else {
+			name := op.Path
+			err = s.pool.do(func() error {
+				return s.transfer(name)
+			})
+		}
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Debugf("sync %s", op)
+	}
+	if err := s.pool.wait(); err != nil {
+		return err
+	}
+	for i := len(result.Operations) - 1; i >= 0; i-- {
+		if op := result.Operations[i]; op.Op == SyncDelete {
+			if err := s.remove(op.Path); err != nil {
+				log.Error(err)
+				return err
+			}
+			log.Debugf("sync %s", op)
+		}
+	}
+	return nil
+}
+
+func (s *syncTransfer) mkdir(name string) error {
+	if s.put {
+		return s.client.MkdirAll(s.remoteFile(name))
+	}
+	return os.MkdirAll(s.localFile(name), 0755)
+}
+
+func (s *syncTransfer) transfer(name string) error {
+	localPath, remotePath := s.localFile(name), s.remoteFile(name)
+	if s.put {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		if err := s.putLocalFile(localPath, remotePath, info); err != nil {
+			return err
+		}
+		return s.client.Chtimes(remotePath, time.Now(), info.ModTime())
+	}
+	info, err := s.client.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if err := s.getRemoteFile(localPath, remotePath, info); err != nil {
+		return err
+	}
+	return os.Chtimes(localPath, time.Now(), info.ModTime())
+}
+
+func (s *syncTransfer) remove(name string) error {
+	if s.put {
+		return s.client.RemoveAll(s.remoteFile(name))
+	}
+	return os.RemoveAll(s.localFile(name))
+}
+
+func sortedKeys(tree map[string]os.FileInfo) []string {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// name 是否在 dirs 中某个路径之下
+func underAny(name string, dirs map[string]bool) bool {
+	for dir := range dirs {
+		if dir == "" || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
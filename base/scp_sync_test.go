@@ -0,0 +1,109 @@
+package base
+
+import (
+	"infra/base/sshtest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func checkSyncResult(t *testing.T, r *SyncResult, created, updated, deleted, unchanged int) {
+	t.Helper()
+	if r.Created != created || r.Updated != updated || r.Deleted != deleted || r.Unchanged != unchanged {
+		t.Fatalf("got %d created, %d updated, %d deleted, %d unchanged, want %d, %d, %d, %d:\n%s",
+			r.Created, r.Updated, r.Deleted, r.Unchanged, created, updated, deleted, unchanged, r)
+	}
+}
+
+func checkNotExist(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s: want removed, got %v", p, err)
+		}
+	}
+}
+
+func TestSyncPut(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "new", "sub/b.txt": "bbb", "sub/c.txt": "ccc"}
+	writeTree(t, dir, files)
+	writeTree(t, s.Path("/dst"), map[string]string{"a.txt": "old!", "stale.txt": "s", "old/x.txt": "x"})
+	opts := &SyncOptions{Delete: true, DryRun: true}
+
+	r, err := SyncPut(h, ssh.Config{}, dir, "/dst", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 3, 1, 2, 0)
+	want := []SyncOperation{
+		{Op: SyncUpdate, Path: "a.txt", Size: 3},
+		{Op: SyncCreate, Path: "sub", IsDir: true},
+		{Op: SyncCreate, Path: "sub/b.txt", Size: 3},
+		{Op: SyncCreate, Path: "sub/c.txt", Size: 3},
+		{Op: SyncDelete, Path: "old", IsDir: true},
+		{Op: SyncDelete, Path: "stale.txt"},
+	}
+	if !r.DryRun || r.Bytes != 9 || !reflect.DeepEqual(r.Operations, want) {
+		t.Fatalf("unexpected plan:\n%s", r)
+	}
+	// 只生成计划，目标不变
+	checkTree(t, s.Path("/dst"), map[string]string{"a.txt": "old!", "stale.txt": "s", "old/x.txt": "x"})
+	checkNotExist(t, s.Path("/dst/sub"))
+
+	opts.DryRun = false
+	r, err = SyncPut(h, ssh.Config{}, dir, "/dst", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 3, 1, 2, 0)
+	checkTree(t, s.Path("/dst"), files)
+	checkNotExist(t, s.Path("/dst/stale.txt"), s.Path("/dst/old"))
+
+	// 再次同步没有变化
+	r, err = SyncPut(h, ssh.Config{}, dir, "/dst", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 0, 0, 0, 3)
+	if len(r.Operations) != 0 || r.Bytes != 0 {
+		t.Fatalf("second sync is not a no-op:\n%s", r)
+	}
+}
+
+func TestSyncGet(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "aaa", "sub/b.txt": "bbb"}
+	writeTree(t, s.Path("/src"), files)
+	writeTree(t, dir, map[string]string{"extra.txt": "e", "sub/old/x.txt": "x"})
+
+	// 不删除时保留目标中多余的文件
+	r, err := SyncGet(h, ssh.Config{}, dir, "/src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 2, 0, 0, 0)
+	checkTree(t, dir, files)
+	checkTree(t, dir, map[string]string{"extra.txt": "e", "sub/old/x.txt": "x"})
+
+	r, err = SyncGet(h, ssh.Config{}, dir, "/src", &SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 0, 0, 2, 2)
+	checkNotExist(t, filepath.Join(dir, "extra.txt"), filepath.Join(dir, "sub", "old"))
+
+	r, err = SyncGet(h, ssh.Config{}, dir, "/src", &SyncOptions{Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyncResult(t, r, 0, 0, 0, 2)
+	if len(r.Operations) != 0 {
+		t.Fatalf("second sync is not a no-op:\n%s", r)
+	}
+}
@@ -0,0 +1,279 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"infra/base/sshtest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 相对路径 -> 内容
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != content {
+			t.Fatalf("%s: content differs, got %d bytes, want %d", name, len(b), len(content))
+		}
+	}
+}
+
+func TestScpFile(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 10000)
+	writeTree(t, dir, map[string]string{"a.txt": content})
+	if err := os.MkdirAll(s.Path("/data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "a.txt"), "/data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, s.Path("/data"), map[string]string{"a.txt": content})
+
+	if err := ScpGet(h, ssh.Config{}, filepath.Join(dir, "b.txt"), "/data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, map[string]string{"b.txt": content})
+}
+
+func TestScpDirectory(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "aaa",
+		"empty":         "",
+		"sub/b.txt":     strings.Repeat("b", 100000),
+		"sub/deep/c.sh": "#!/bin/sh\n",
+	}
+	writeTree(t, filepath.Join(dir, "src"), files)
+
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "src"), "/data/dst"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, s.Path("/data/dst"), files)
+
+	if err := ScpGet(h, ssh.Config{}, filepath.Join(dir, "back"), "/data/dst"); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(dir, "back"), files)
+}
+
+func TestScpResume(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	content := strings.Repeat("0123456789", 1000)
+	writeTree(t, dir, map[string]string{"a.txt": content})
+	opts := &ScpOptions{Resume: true}
+
+	// 已传输的部分从中断处继续
+	writeTree(t, s.Path("/"), map[string]string{"a.txt": content[:4000]})
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "a.txt"), "/a.txt", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, s.Path("/"), map[string]string{"a.txt": content})
+
+	// 大小相同但修改时间不同，重新传输
+	writeTree(t, s.Path("/"), map[string]string{"a.txt": strings.Repeat("x", len(content))})
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(s.Path("/a.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "a.txt"), "/a.txt", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, s.Path("/"), map[string]string{"a.txt": content})
+}
+
+func TestScpIncludeSkipsEmptyDirectories(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	writeTree(t, filepath.Join(dir, "src"), map[string]string{
+		"conf/app.yaml":  "a: 1",
+		"logs/app.log":   "log",
+		"lib/x/y/z.so":   "so",
+		"lib/x/conf.yml": "b: 2",
+	})
+	opts := &ScpOptions{Filter: &ScpFilter{Include: []string{"*.yaml", "*.yml"}}}
+
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "src"), "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := ScpGet(h, ssh.Config{}, filepath.Join(dir, "back"), "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{s.Path("/dst"), filepath.Join(dir, "back")} {
+		checkTree(t, root, map[string]string{"conf/app.yaml": "a: 1", "lib/x/conf.yml": "b: 2"})
+		for _, name := range []string{"logs", "lib/x/y"} {
+			if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+				t.Fatalf("%s: empty directory %s created", root, name)
+			}
+		}
+	}
+}
+
+func TestScpAtomicRemovesTempFile(t *testing.T) {
+	// 校验命令总是返回错误的结果
+	s, h := newTestServer(t, &sshtest.Config{Handler: func(req *sshtest.Request) int {
+		_, _ = req.Stdout.Write([]byte(strings.Repeat("0", 64) + "  file\n"))
+		return 0
+	}})
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"app.conf": "new"})
+	writeTree(t, s.Path("/etc"), map[string]string{"app.conf": "old"})
+
+	err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "app.conf"), "/etc/app.conf",
+		&ScpOptions{Atomic: true, Checksum: SHA256Checksum})
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("error = %v, want ChecksumMismatchError", err)
+	}
+	checkTree(t, s.Path("/etc"), map[string]string{"app.conf": "old"})
+	files, err := ioutil.ReadDir(s.Path("/etc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temp file left: %d files in /etc", len(files))
+	}
+}
+
+func TestScpAtomicFollowsSymlink(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"app.conf": "new"})
+	writeTree(t, s.Path("/etc/conf.d"), map[string]string{"app.conf": "old"})
+	if err := os.Symlink("conf.d/app.conf", s.Path("/etc/app.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "app.conf"), "/etc/app.conf",
+		&ScpOptions{Atomic: true, BackupSuffix: ".bak"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(s.Path("/etc/app.conf"))
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("link replaced: %v, %v", info, err)
+	}
+	checkTree(t, s.Path("/etc/conf.d"), map[string]string{"app.conf": "new", "app.conf.bak": "old"})
+}
+
+func TestScpReleasesHostBandwidth(t *testing.T) {
+	_, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a.txt": "aaa"})
+	h.BandwidthLimit = 1 << 20
+
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "a.txt"), "/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	bandwidthLock.Lock()
+	defer bandwidthLock.Unlock()
+	if _, ok := hostBandwidth[poolKey(h)]; ok {
+		t.Fatal("host bandwidth limiter kept after the transfer finished")
+	}
+}
+
+func TestScpPreserve(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeTree(t, src, map[string]string{"bin/run.sh": "#!/bin/sh\n"})
+	if err := os.Chmod(filepath.Join(src, "bin/run.sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(src, "bin/run.sh"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/run.sh", filepath.Join(src, "run")); err != nil {
+		t.Fatal(err)
+	}
+	opts := &ScpOptions{Preserve: true}
+
+	check := func(root string) {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(root, "bin/run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0750 || !info.ModTime().Equal(mtime) {
+			t.Fatalf("%s: got mode %v mtime %v, want 0750 %v", root, info.Mode(), info.ModTime(), mtime)
+		}
+		// 链接被重建而不是复制指向的文件
+		target, err := os.Readlink(filepath.Join(root, "run"))
+		if err != nil || target != "bin/run.sh" {
+			t.Fatalf("%s: got link %q, %v", root, target, err)
+		}
+	}
+
+	if err := ScpPut(h, ssh.Config{}, src, "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	check(s.Path("/dst"))
+
+	back := filepath.Join(dir, "back")
+	if err := ScpGet(h, ssh.Config{}, back, "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	check(back)
+}
+
+func TestScpConcurrent(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("d%d/f%d", i%4, i)] = strings.Repeat(strconv.Itoa(i), 50000+i*1000)
+	}
+	writeTree(t, filepath.Join(dir, "src"), files)
+
+	var last ScpProgress
+	opts := &ScpOptions{Concurrency: 4, OnProgress: func(p ScpProgress) { last = p }}
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "src"), "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, s.Path("/dst"), files)
+	if last.Files != 20 || last.TotalFiles != 20 || last.Bytes != last.TotalBytes {
+		t.Fatalf("unexpected final progress %+v", last)
+	}
+
+	if err := ScpGet(h, ssh.Config{}, filepath.Join(dir, "back"), "/dst", opts); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(dir, "back"), files)
+
+	// 一个文件失败时整体返回错误
+	if err := os.MkdirAll(s.Path("/fail/d0/f0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ScpPut(h, ssh.Config{}, filepath.Join(dir, "src"), "/fail", opts); err == nil {
+		t.Fatal("want error when a file cannot be written")
+	}
+}
@@ -0,0 +1,61 @@
+package base
+
+import (
+	"context"
+	"sync"
+)
+
+// 并发传输文件的工作池，所有文件共用一个 sftp 客户端，一个文件失败后取消其余的传输
+type transferPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+// n 小于等于 1 时返回 nil，文件在调用方依次传输
+func newTransferPool(ctx context.Context, n int) *transferPool {
+	if n <= 1 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return &transferPool{ctx: ctx, cancel: cancel, sem: make(chan struct{}, n)}
+}
+
+// 有空闲的 worker 时在后台执行 fn，池为 nil 时直接执行
+func (p *transferPool) do(fn func() error) error {
+	if p == nil {
+		return fn()
+	}
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.sem
+			p.wg.Done()
+		}()
+		if err := fn(); err != nil {
+			p.once.Do(func() {
+				p.err = err
+				p.cancel()
+			})
+		}
+	}()
+	return nil
+}
+
+// 等待全部传输完成，返回第一个错误
+func (p *transferPool) wait() error {
+	if p == nil {
+		return nil
+	}
+	p.wg.Wait()
+	p.cancel()
+	return p.err
+}
@@ -0,0 +1,118 @@
+package base
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const defaultScriptDir = "/tmp"
+
+// 远程脚本选项
+type ScriptOptions struct {
+	// 本地脚本路径，与 Content 二选一
+	Path    string
+	Content []byte
+	// 解释器，如 /bin/bash、/usr/bin/env python，为空时为 /bin/sh
+	Interpreter string
+	Args        []string
+	Envs        []EnvMap
+	// 不为空时提权执行
+	Escalate *EscalateOptions
+	// 远程临时目录，为空时为 /tmp
+	TempDir string
+}
+
+func RunScript(h *Host, cfg ssh.Config, opts *ScriptOptions) (*CommandResult, error) {
+	return RunScriptContext(context.Background(), h, cfg, opts)
+}
+
+// 上传脚本到远程临时文件并执行，无论成功、失败或取消都会删除临时文件
+func RunScriptContext(ctx context.Context, h *Host, cfg ssh.Config, opts *ScriptOptions) (*CommandResult, error) {
+	if opts == nil {
+		opts = &ScriptOptions{}
+	}
+	content := opts.Content
+	if opts.Path != "" {
+		var err error
+		content, err = ioutil.ReadFile(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+	} else if content == nil {
+		return nil, errors.New("script path or content is required")
+	}
+
+	conn, client, release, err := openClients(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	remotePath, err := scriptTempPath(opts)
+	if err != nil {
+		return nil, err
+	}
+	remoteFile, err := client.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := client.Remove(remotePath); err != nil {
+			log.Warnf("remove script %s on %s failed: %v", remotePath, hostName(h), err)
+		}
+	}()
+
+	// 脚本中可能有密码，写入内容前先去掉其他用户的权限
+	err = remoteFile.Chmod(0700)
+	if err == nil {
+		_, err = remoteFile.Write(content)
+	}
+	if err == nil {
+		err = remoteFile.Close()
+	} else {
+		remoteFile.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// 以其它普通用户执行时需要对方可读
+	if opts.Escalate != nil && opts.Escalate.User != "" && opts.Escalate.User != "root" {
+		if err := client.Chmod(remotePath, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	interpreter := opts.Interpreter
+	if interpreter == "" {
+		interpreter = "/bin/sh"
+	}
+	command := interpreter + " " + shellJoin(append([]string{remotePath}, opts.Args...)...)
+	if opts.Escalate != nil {
+		return escalateCommand(ctx, conn, h, command, opts.Escalate, opts.Envs...)
+	}
+	return runCommand(ctx, conn, h, command, opts.Envs...)
+}
+
+func scriptTempPath(opts *ScriptOptions) (string, error) {
+	dir := opts.TempDir
+	if dir == "" {
+		dir = defaultScriptDir
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	name := "base-script-" + hex.EncodeToString(b)
+	if opts.Path != "" {
+		name += filepath.Ext(opts.Path)
+	}
+	return path.Join(dir, name), nil
+}
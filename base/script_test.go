@@ -0,0 +1,54 @@
+package base
+
+import (
+	"context"
+	"infra/base/sshtest"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunScript(t *testing.T) {
+	var s *sshtest.Server
+	s, h := newTestServer(t, &sshtest.Config{Handler: func(req *sshtest.Request) int {
+		// /bin/sh /tmp/base-script-xxx args...
+		words := strings.Fields(req.Command)
+		if len(words) < 2 || words[0] != "/bin/sh" {
+			return 127
+		}
+		info, err := os.Stat(s.Path(words[1]))
+		if err != nil {
+			return 1
+		}
+		content, err := ioutil.ReadFile(s.Path(words[1]))
+		if err != nil {
+			return 1
+		}
+		_, _ = req.Stdout.Write([]byte(info.Mode().Perm().String() + " " + string(content) + " " + strings.Join(words[2:], " ")))
+		return 0
+	}})
+	if err := os.MkdirAll(s.Path("/tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := RunScriptContext(context.Background(), h, ssh.Config{}, &ScriptOptions{
+		Content: []byte("echo secret"),
+		Args:    []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "-rwx------ echo secret a b"; result.Stdout != want {
+		t.Fatalf("stdout = %q, want %q", result.Stdout, want)
+	}
+	if files, _ := ioutil.ReadDir(s.Path("/tmp")); len(files) != 0 {
+		t.Fatalf("script not removed: %d files left", len(files))
+	}
+
+	if _, err := RunScriptContext(context.Background(), h, ssh.Config{}, nil); err == nil {
+		t.Fatal("nil options without content succeeded")
+	}
+}
@@ -1,197 +1,225 @@
 package base
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"fmt"
-	"github.com/mitchellh/go-homedir"
-	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 	"io"
-	"io/ioutil"
 	"net"
-	"os"
-	"strings"
+	"strconv"
 	"time"
 )
 
-func NewSSHClient(h *Host, cfg ssh.Config) (*ssh.Client, error) {
-	config := &ssh.ClientConfig{
-		Config: cfg,
-		User:   h.User,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
-		},
-		Timeout: time.Second * 5,
-	}
+const defaultTimeout = time.Second * 5
 
-	if h.AuthType == PasswordAuth {
-		config.Auth = []ssh.AuthMethod{ssh.Password(h.Password)}
-	} else {
-		config.Auth = []ssh.AuthMethod{publicKeyAuthFunc(h.KeyFile)}
-	}
+func NewSSHClient(h *Host, cfg ssh.Config) (*ssh.Client, error) {
+	return NewSSHClientContext(context.Background(), h, cfg)
+}
 
-	addr := fmt.Sprintf("%s:%d", h.Ip, h.Port)
-	client, err := ssh.Dial("tcp", addr, config)
+// 建立连接，ctx 取消或超时会中断拨号和握手，配置了 Host.Retry 时按策略重试
+func NewSSHClientContext(ctx context.Context, h *Host, cfg ssh.Config) (*ssh.Client, error) {
+	var client *ssh.Client
+	err := h.Retry.do(ctx, hostName(h), func() error {
+		var err error
+		client, err = dialSSH(ctx, h, cfg)
+		return err
+	})
 	return client, err
 }
 
-func hostKeyCallBackFunc(host string) ssh.HostKeyCallback {
-	hostPath, _ := homedir.Expand("~/.ssh/known_hosts")
-	file, err := os.Open(hostPath)
+func dialSSH(ctx context.Context, h *Host, cfg ssh.Config) (*ssh.Client, error) {
+	config, err := newClientConfig(h, cfg)
 	if err != nil {
-		log.Fatalf("cannot find known_hosts file :%v", err)
+		return nil, err
 	}
 
-	defer file.Close()
+	addr := hostAddr(h)
+	if len(h.Jumps) > 0 {
+		return dialViaJumps(ctx, h, cfg, addr, config)
+	}
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newClientConn(ctx, conn, addr, config)
+}
 
-	scanner := bufio.NewScanner(file)
+func hostAddr(h *Host) string {
+	return net.JoinHostPort(h.Ip, strconv.Itoa(h.Port))
+}
 
-	var hostKey ssh.PublicKey
+// 依次经过跳板机建立到目标主机的连接，每一跳使用各自的认证信息，
+// 目标连接断开时自动关闭所有跳板机连接，重试由目标主机的策略控制，整条链路重新建立
+func dialViaJumps(ctx context.Context, h *Host, cfg ssh.Config, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+
+	prev, err := dialSSH(ctx, h.Jumps[0], cfg)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", hostName(h.Jumps[0]), err)
+	}
+	hops = append(hops, prev)
 
-	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), " ")
-		if len(fields) != 3 {
-			continue
+	for _, jump := range h.Jumps[1:] {
+		jumpConfig, err := newClientConfig(jump, cfg)
+		if err != nil {
+			closeHops()
+			return nil, err
 		}
-		if fields[0] == host {
-			var err error
-			hostKey, _, _, _, err = ssh.ParseAuthorizedKey(scanner.Bytes())
-			if err != nil {
-				log.Fatalf("error parsing %s:%v", fields[2], err)
-			}
-			break
+		prev, err = dialThrough(ctx, prev, hostAddr(jump), jumpConfig)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", hostName(jump), err)
 		}
+		hops = append(hops, prev)
 	}
-	if hostKey == nil {
-		log.Fatalf("no hostkey for %s,%v", host, err)
-	}
-	return ssh.FixedHostKey(hostKey)
-}
 
-func publicKeyAuthFunc(keyFile string) ssh.AuthMethod {
-	key, err := ioutil.ReadFile(keyFile)
+	client, err := dialThrough(ctx, prev, addr, config)
 	if err != nil {
-		log.Fatal("ssh key file read failed ", err)
+		closeHops()
+		return nil, err
 	}
-	signer, err := ssh.ParsePrivateKey(key)
+	go func() {
+		_ = client.Wait()
+		closeHops()
+	}()
+	return client, nil
+}
+
+func dialThrough(ctx context.Context, via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.DialContext(ctx, "tcp", addr)
 	if err != nil {
-		log.Fatal("ssh key signer failed ", err)
+		return nil, err
 	}
-	return ssh.PublicKeys(signer)
+	return newClientConn(ctx, conn, addr, config)
 }
 
-type EnvMap map[string]string
-
-func runCommand(client *ssh.Client, command string, envs ...EnvMap) (stdout string, err error) {
-	session, err := client.NewSession()
+func newClientConfig(h *Host, cfg ssh.Config) (*ssh.ClientConfig, error) {
+	callback, err := hostKeyCallback(h)
 	if err != nil {
-		return
+		return nil, err
 	}
-	defer session.Close()
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	auth, err := authMethods(h)
+	if err != nil {
+		return nil, err
+	}
+	algorithms, err := hostKeyAlgorithms(h)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.ClientConfig{
+		Config:            cfg,
+		User:              h.User,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           timeout,
+	}, nil
+}
 
-	var outputBuf bytes.Buffer
-	var errorBuf bytes.Buffer
-	session.Stdout = &outputBuf
-	session.Stderr = &errorBuf
-	// 设置环境变量
-	for _, env := range envs {
-		for k, v := range env {
-			err = session.Setenv(k, v)
-			if err != nil {
-				return
-			}
+// 在已建立的连接上完成 ssh 握手
+func newClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	deadline := time.Now().Add(config.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
 		}
-	}
+	}()
 
-	err = session.Run(command)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		stderr := string(errorBuf.Bytes())
-		err = fmt.Errorf(stderr)
-		return
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
-	stdout = string(outputBuf.Bytes())
-	return
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func sudoCommand(client *ssh.Client, command string, user string, password string, envs ...EnvMap) (stdout string, err error) {
-	session, err := client.NewSession()
-	if err != nil {
-		return
+// 等待命令结束，ctx 取消时向远程进程发送信号并关闭 session
+func waitSession(ctx context.Context, session *ssh.Session) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		_ = session.Signal(ssh.SIGTERM)
+		session.Close()
+		<-done
+		return ctx.Err()
 	}
-	defer session.Close()
+}
+
+type EnvMap map[string]string
 
+func runCommand(ctx context.Context, client *ssh.Client, h *Host, command string, envs ...EnvMap) (*CommandResult, error) {
 	var outputBuf bytes.Buffer
 	var errorBuf bytes.Buffer
-	session.Stdout = &outputBuf
-	session.Stderr = &errorBuf
-	// 设置环境变量
-	for _, env := range envs {
-		for k, v := range env {
-			err = session.Setenv(k, v)
-			if err != nil {
-				return
-			}
-		}
+	result, err := execCommand(ctx, client, h, command, &outputBuf, &errorBuf, envs...)
+	if result != nil {
+		result.Stdout = outputBuf.String()
+		result.Stderr = errorBuf.String()
 	}
+	return result, err
+}
 
-	in, err := session.StdinPipe()
-	if err != nil {
-		return
-	}
+// 执行命令，输出写入 stdout、stderr，返回的结果中不包含输出内容
+func execCommand(ctx context.Context, client *ssh.Client, h *Host, command string, stdout, stderr io.Writer, envs ...EnvMap) (result *CommandResult, err error) {
+	start := time.Now()
+	counter := &byteCounter{}
+	defer func() {
+		auditCommand(h, AuditExec, "", command, start, result, counter.count(), err)
+	}()
 
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          0,     // disable echoing
-		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
 	}
+	defer session.Close()
 
-	err = session.RequestPty("xterm", 80, 40, modes)
+	session.Stdout = io.MultiWriter(stdout, counter)
+	session.Stderr = io.MultiWriter(stderr, counter)
+	// 设置环境变量
+	prefix, err := applyEnv(session, h, envs)
 	if err != nil {
-		return
-	}
-
-	var (
-		prefix    = fmt.Sprintf("[sudo] password for %s:", user)
-		prefixLen = len(prefix)
-	)
-
-	abort := make(chan bool)
-
-	go func(in io.Writer, output *bytes.Buffer, done <-chan bool) {
-
-		for {
-			select {
-			case <-done:
-				return
-			default:
-				content := string(output.Bytes())
-				if len(content) < prefixLen {
-					continue
-				}
-				if strings.HasPrefix(content, prefix) {
-					_, err = in.Write([]byte(password + "\n"))
-					if err == io.EOF {
-						log.Debug(err)
-						err = nil
-					}
-					break
-				}
-			}
-		}
-	}(in, &outputBuf, abort)
-
-	defer func() {
-		abort <- true
-	}()
+		return nil, err
+	}
 
-	err = session.Run("sudo " + command)
+	result = &CommandResult{Host: hostName(h), Command: command}
+	start = time.Now()
+	err = session.Start(prefix + command)
 	if err != nil {
-		stderr := string(errorBuf.Bytes())
-		err = fmt.Errorf(stderr)
-		return
+		return nil, err
 	}
-
-	stdout = strings.TrimPrefix(string(outputBuf.Bytes()), prefix)
-	return
+	err = waitSession(ctx, session)
+	result.Duration = time.Since(start)
+	if ctx.Err() != nil {
+		result.ExitCode = -1
+		return result, ctx.Err()
+	}
+	return result, commandError(result, err)
 }
@@ -1,34 +1,71 @@
 package base
 
-import "golang.org/x/crypto/ssh"
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+)
 
 func RunCmd(h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (output string, err error) {
-	conn, err := NewSSHClient(h, cfg)
-	defer conn.Close()
-	if err != nil {
-		return
+	return RunCmdContext(context.Background(), h, cfg, cmd, envs...)
+}
+
+// ctx 取消时向远程进程发送信号，关闭 session 并返回 ctx.Err()
+func RunCmdContext(ctx context.Context, h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (output string, err error) {
+	result, err := RunCmdResultContext(ctx, h, cfg, cmd, envs...)
+	if result != nil {
+		output = result.Stdout
 	}
-	output, err = runCommand(conn, cmd, envs...)
 	return
 }
 
-func RunSudoCmd(h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (output string, err error) {
-	conn, err := NewSSHClient(h, cfg)
-	defer conn.Close()
+// 执行命令并返回完整结果，命令退出码非 0 时返回 *ExitError
+func RunCmdResult(h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (*CommandResult, error) {
+	return RunCmdResultContext(context.Background(), h, cfg, cmd, envs...)
+}
+
+func RunCmdResultContext(ctx context.Context, h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (*CommandResult, error) {
+	conn, release, err := openSSHClient(ctx, h, cfg)
 	if err != nil {
-		return
+		return nil, err
+	}
+	defer release()
+	return runCommand(ctx, conn, h, cmd, envs...)
+}
+
+func RunSudoCmd(h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (output string, err error) {
+	return RunSudoCmdContext(context.Background(), h, cfg, cmd, envs...)
+}
+
+// ctx 取消时向远程进程发送信号，关闭 session 并返回 ctx.Err()
+func RunSudoCmdContext(ctx context.Context, h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (output string, err error) {
+	result, err := RunSudoCmdResultContext(ctx, h, cfg, cmd, envs...)
+	if result != nil {
+		output = result.Stdout
 	}
-	output, err = sudoCommand(conn, cmd, h.User, h.Password, envs...)
 	return
 }
 
+// 以 sudo 执行命令并返回完整结果，命令退出码非 0 时返回 *ExitError
+func RunSudoCmdResult(h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (*CommandResult, error) {
+	return RunSudoCmdResultContext(context.Background(), h, cfg, cmd, envs...)
+}
+
+func RunSudoCmdResultContext(ctx context.Context, h *Host, cfg ssh.Config, cmd string, envs ...EnvMap) (*CommandResult, error) {
+	conn, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return sudoCommand(ctx, conn, h, cmd, envs...)
+}
+
 //判断文件是否存在
 func FileExist(h *Host, cfg ssh.Config, path string) error {
-	client, err := NewSftpClient(h, cfg)
-	defer client.Close()
+	client, release, err := openSftpClient(context.Background(), h, cfg)
 	if err != nil {
 		return err
 	}
+	defer release()
 	_, err = client.Lstat(path)
 	return err
 }
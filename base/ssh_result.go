@@ -0,0 +1,63 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"time"
+)
+
+// 远程命令执行结果
+type CommandResult struct {
+	Host     string        `json:"host"`
+	Command  string        `json:"command"`
+	ExitCode int           `json:"exitCode"`
+	Signal   string        `json:"signal,omitempty"`
+	Stdout   string        `json:"stdout"`
+	Stderr   string        `json:"stderr"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (r *CommandResult) Success() bool {
+	return r.ExitCode == 0 && r.Signal == ""
+}
+
+// 远程命令执行完成但退出码非 0，可通过 errors.As 与连接类错误区分
+type ExitError struct {
+	*CommandResult
+}
+
+func (e *ExitError) Error() string {
+	status := fmt.Sprintf("status %d", e.ExitCode)
+	if e.Signal != "" {
+		status = "signal " + e.Signal
+	}
+	stderr := strings.TrimSpace(e.Stderr)
+	if stderr == "" {
+		return fmt.Sprintf("command on %s exited with %s", e.Host, status)
+	}
+	return fmt.Sprintf("command on %s exited with %s: %s", e.Host, status, stderr)
+}
+
+func hostName(h *Host) string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Ip
+}
+
+// 根据 session.Run 的返回值补全执行结果，命令本身执行失败时返回 *ExitError
+func commandError(result *CommandResult, err error) error {
+	if err == nil {
+		return nil
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitStatus()
+		result.Signal = exitErr.Signal()
+		return &ExitError{CommandResult: result}
+	}
+	result.ExitCode = -1
+	return err
+}
@@ -0,0 +1,163 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync"
+)
+
+const (
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+)
+
+// 远程命令输出的一行
+type OutputLine struct {
+	Host   string `json:"host"`
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// 流式输出选项，Stdout、Stderr 接收原始输出，OnLine 按行回调
+type StreamOptions struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	OnLine func(line OutputLine)
+}
+
+// 将输出逐行写入 logrus，可直接作为 StreamOptions.OnLine
+func LogOutputLine(line OutputLine) {
+	entry := log.WithFields(log.Fields{"host": line.Host, "stream": line.Stream})
+	if line.Stream == StderrStream {
+		entry.Warn(line.Text)
+		return
+	}
+	entry.Info(line.Text)
+}
+
+// 执行命令并实时输出，返回的结果中不包含 Stdout、Stderr
+func RunCmdStream(ctx context.Context, h *Host, cfg ssh.Config, cmd string, opts *StreamOptions, envs ...EnvMap) (*CommandResult, error) {
+	conn, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return streamCommand(ctx, conn, h, cmd, opts, envs...)
+}
+
+func streamCommand(ctx context.Context, client *ssh.Client, h *Host, command string, opts *StreamOptions, envs ...EnvMap) (*CommandResult, error) {
+	stdout, stderr, flush := streamWriters(hostName(h), opts)
+	defer flush()
+	return execCommand(ctx, client, h, command, stdout, stderr, envs...)
+}
+
+// stdout 和 stderr 由 session 的不同协程写入，共用一把锁保证调用方的 writer 和回调串行
+func streamWriters(host string, opts *StreamOptions) (stdout io.Writer, stderr io.Writer, flush func()) {
+	if opts == nil {
+		opts = &StreamOptions{}
+	}
+	mutex := &sync.Mutex{}
+	outLines := &lineWriter{host: host, stream: StdoutStream, onLine: opts.OnLine}
+	errLines := &lineWriter{host: host, stream: StderrStream, onLine: opts.OnLine}
+	stdout = &lockedWriter{mutex: mutex, writers: []io.Writer{opts.Stdout, outLines}}
+	stderr = &lockedWriter{mutex: mutex, writers: []io.Writer{opts.Stderr, errLines}}
+	flush = func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		outLines.Flush()
+		errLines.Flush()
+	}
+	return
+}
+
+type lockedWriter struct {
+	mutex   *sync.Mutex
+	writers []io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, writer := range w.writers {
+		if writer == nil {
+			continue
+		}
+		if _, err := writer.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// 按行切分输出，不完整的行缓存到下一次写入或 Flush
+type lineWriter struct {
+	host   string
+	stream string
+	onLine func(line OutputLine)
+	buf    bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.onLine == nil {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.emit(line[:i])
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Flush() {
+	if w.onLine == nil || w.buf.Len() == 0 {
+		return
+	}
+	w.emit(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+func (w *lineWriter) emit(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	w.onLine(OutputLine{Host: w.host, Stream: w.stream, Text: string(line)})
+}
+
+// 为每行输出加上主机名前缀后写入 w，多台主机共用同一个 w 时输出不会交错在一行内
+func NewHostWriter(host string, w io.Writer) io.WriteCloser {
+	hw := &hostWriter{w: w}
+	hw.lines = lineWriter{host: host, onLine: hw.writeLine}
+	return hw
+}
+
+type hostWriter struct {
+	w     io.Writer
+	lines lineWriter
+	err   error
+}
+
+func (h *hostWriter) writeLine(line OutputLine) {
+	if h.err != nil {
+		return
+	}
+	_, h.err = io.WriteString(h.w, "["+line.Host+"] "+line.Text+"\n")
+}
+
+func (h *hostWriter) Write(p []byte) (int, error) {
+	if h.err != nil {
+		return 0, h.err
+	}
+	return h.lines.Write(p)
+}
+
+// 输出最后不完整的一行
+func (h *hostWriter) Close() error {
+	h.lines.Flush()
+	return h.err
+}
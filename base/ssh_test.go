@@ -0,0 +1,128 @@
+package base
+
+import (
+	"errors"
+	"infra/base/sshtest"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 启动本地的 ssh 服务，返回可以直接连接的主机，用户为 alice/secret
+func newTestServer(t *testing.T, cfg *sshtest.Config) (*sshtest.Server, *Host) {
+	t.Helper()
+	if cfg.Users == nil {
+		cfg.Users = map[string]string{"alice": "secret"}
+	}
+	s, err := sshtest.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, &Host{
+		Ip:                 "127.0.0.1",
+		Port:               s.Port,
+		User:               "alice",
+		Password:           "secret",
+		AuthType:           PasswordAuth,
+		Platform:           LinuxPlatform,
+		HostKeyPolicy:      FingerprintHostKey,
+		HostKeyFingerprint: ssh.FingerprintSHA256(s.HostKey),
+	}
+}
+
+func TestPasswordAuth(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	s.Respond("hostname", "box\n", 0)
+
+	out, err := RunCmd(h, ssh.Config{}, "hostname")
+	if err != nil || out != "box\n" {
+		t.Fatalf("RunCmd = %q, %v", out, err)
+	}
+
+	h.Password = "wrong"
+	if _, err := RunCmd(h, ssh.Config{}, "hostname"); err == nil {
+		t.Fatal("login with wrong password succeeded")
+	}
+}
+
+func TestKeyAuth(t *testing.T) {
+	key, err := sshtest.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, h := newTestServer(t, &sshtest.Config{
+		AuthorizedKeys: map[string][]ssh.PublicKey{"alice": {key.PublicKey()}},
+	})
+	s.Respond("hostname", "box\n", 0)
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, []byte(key.PEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Password = ""
+	for _, auth := range []struct {
+		authType   authType
+		keyFile    string
+		privateKey string
+	}{
+		{authType: PrivateKeyAuth, privateKey: key.PEM},
+		{authType: KeyFileAuth, keyFile: keyFile},
+	} {
+		h.AuthType, h.KeyFile, h.PrivateKey = auth.authType, auth.keyFile, auth.privateKey
+		out, err := RunCmd(h, ssh.Config{}, "hostname")
+		if err != nil || out != "box\n" {
+			t.Fatalf("%s: RunCmd = %q, %v", auth.authType, out, err)
+		}
+	}
+
+	other, err := sshtest.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.AuthType, h.KeyFile, h.PrivateKey = PrivateKeyAuth, "", other.PEM
+	if _, err := RunCmd(h, ssh.Config{}, "hostname"); err == nil {
+		t.Fatal("login with unauthorized key succeeded")
+	}
+}
+
+func TestRunCmdExitCode(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{})
+	s.Respond("true", "", 0)
+	s.Respond("false", "", 1)
+	s.Handle("fail", func(req *sshtest.Request) int {
+		_, _ = req.Stdout.Write([]byte("out\n"))
+		_, _ = req.Stderr.Write([]byte("err\n"))
+		return 3
+	})
+
+	for _, c := range []struct {
+		cmd    string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{cmd: "true", code: 0},
+		{cmd: "false", code: 1},
+		{cmd: "fail", code: 3, stdout: "out\n", stderr: "err\n"},
+		{cmd: "missing", code: 127, stderr: "sh: missing: command not found\n"},
+	} {
+		result, err := RunCmdResult(h, ssh.Config{}, c.cmd)
+		if result == nil {
+			t.Fatalf("%s: no result: %v", c.cmd, err)
+		}
+		if result.ExitCode != c.code || result.Stdout != c.stdout || result.Stderr != c.stderr {
+			t.Fatalf("%s: got %d %q %q, want %d %q %q", c.cmd,
+				result.ExitCode, result.Stdout, result.Stderr, c.code, c.stdout, c.stderr)
+		}
+		var exitErr *ExitError
+		if c.code == 0 && err != nil {
+			t.Fatalf("%s: %v", c.cmd, err)
+		}
+		if c.code != 0 && (!errors.As(err, &exitErr) || exitErr.ExitCode != c.code) {
+			t.Fatalf("%s: error = %v, want exit status %d", c.cmd, err, c.code)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package sshtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const sudoMaxTries = 3
+
+// 模拟 sudo：-n 在需要密码时直接失败，-S 从 stdin 读取密码，-p 自定义提示，
+// 密码错误时提示 Sorry, try again. 并重新询问，之后把 sh -c 的命令交给处理函数
+func (s *Server) sudo(req *Request, words []string) int {
+	var (
+		nonInteractive bool
+		prompt         string
+		runAs          = "root"
+		i              = 1
+	)
+	for ; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(word, "-") {
+			break
+		}
+		switch word {
+		case "-n":
+			nonInteractive = true
+		case "-p", "-u":
+			if i+1 >= len(words) {
+				fmt.Fprintf(req.Stderr, "sudo: option requires an argument -- '%s'\n", word[1:])
+				return 1
+			}
+			i++
+			if word == "-p" {
+				prompt = words[i]
+			} else {
+				runAs = words[i]
+			}
+		}
+	}
+	args := words[i:]
+	if len(args) == 0 {
+		fmt.Fprintln(req.Stderr, "usage: sudo command")
+		return 1
+	}
+
+	if s.config.SudoPassword != "" {
+		if nonInteractive {
+			fmt.Fprintln(req.Stderr, "sudo: a password is required")
+			return 1
+		}
+		if prompt == "" {
+			prompt = "[sudo] password for " + req.User + ": "
+		}
+		reader := bufio.NewReader(req.Stdin)
+		req.Stdin = reader
+		if !readSudoPassword(req, reader, prompt, s.config.SudoPassword) {
+			return 1
+		}
+	}
+
+	command := strings.Join(args, " ")
+	if len(args) >= 3 && args[0] == "sh" && args[1] == "-c" {
+		command = args[2]
+	}
+	inner := *req
+	inner.Command = command
+	inner.Sudo = true
+	inner.RunAs = runAs
+	return s.dispatch(&inner)
+}
+
+func readSudoPassword(req *Request, reader *bufio.Reader, prompt string, password string) bool {
+	for try := 1; try <= sudoMaxTries; try++ {
+		_, _ = io.WriteString(req.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		if req.Pty {
+			// 关闭回显时 sudo 在读到密码后补一个换行
+			_, _ = io.WriteString(req.Stderr, "\n")
+		}
+		if strings.TrimRight(line, "\r\n") == password {
+			return true
+		}
+		if err != nil {
+			fmt.Fprintln(req.Stderr, "sudo: no password was provided")
+			return false
+		}
+		if try < sudoMaxTries {
+			fmt.Fprintln(req.Stderr, "Sorry, try again.")
+		}
+	}
+	fmt.Fprintf(req.Stderr, "sudo: %d incorrect password attempts\n", sudoMaxTries)
+	return false
+}
+
+// 模拟 su [-] user -c command：只能在 pty 中执行，读取一次目标用户的密码，
+// 密码错误时输出 su: Authentication failure 并退出，不会再次询问
+func (s *Server) su(req *Request, words []string) int {
+	var (
+		runAs   = "root"
+		command string
+	)
+	for i := 1; i < len(words); i++ {
+		word := words[i]
+		switch {
+		case word == "-" || word == "-l" || word == "--login":
+		case word == "-c":
+			if i+1 >= len(words) {
+				fmt.Fprintln(req.Stderr, "su: option requires an argument -- 'c'")
+				return 1
+			}
+			i++
+			command = words[i]
+		case strings.HasPrefix(word, "-"):
+			fmt.Fprintf(req.Stderr, "su: invalid option -- '%s'\n", strings.TrimLeft(word, "-"))
+			return 1
+		default:
+			runAs = word
+		}
+	}
+	if command == "" {
+		// 不支持交互式 shell
+		fmt.Fprintln(req.Stderr, "usage: su [-] user -c command")
+		return 1
+	}
+
+	if req.User != "root" {
+		password, ok := s.config.SuPasswords[runAs]
+		if !ok {
+			fmt.Fprintf(req.Stderr, "su: user %s does not exist\n", runAs)
+			return 1
+		}
+		if !req.Pty {
+			fmt.Fprintln(req.Stderr, "su: must be run from a terminal")
+			return 1
+		}
+		_, _ = io.WriteString(req.Stdout, "Password: ")
+		reader := bufio.NewReader(req.Stdin)
+		req.Stdin = reader
+		line, _ := reader.ReadString('\n')
+		_, _ = io.WriteString(req.Stdout, "\n")
+		if strings.TrimRight(line, "\r\n") != password {
+			fmt.Fprintln(req.Stderr, "su: Authentication failure")
+			return 1
+		}
+	}
+
+	inner := *req
+	inner.Command = command
+	inner.Su = true
+	inner.RunAs = runAs
+	return s.dispatch(&inner)
+}
+
+// 去掉命令前的 K=V 临时变量
+func stripAssignments(words []string) ([]string, map[string]string) {
+	env := make(map[string]string)
+	for len(words) > 0 {
+		name, value, ok := splitAssignment(words[0])
+		if !ok {
+			break
+		}
+		env[name] = value
+		words = words[1:]
+	}
+	return words, env
+}
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// 去掉命令前的 export K=V; 和 K=V; export K; 前缀，变量写入 env
+func stripEnvPrefix(command string, env map[string]string) string {
+	for {
+		rest := strings.TrimLeft(command, " ")
+		if strings.HasPrefix(rest, "export ") {
+			word, tail, err := readWord(strings.TrimPrefix(rest, "export "))
+			name, value, ok := splitAssignment(word)
+			if err != nil || !ok || !strings.HasPrefix(tail, ";") {
+				return rest
+			}
+			env[name] = value
+			command = tail[1:]
+			continue
+		}
+
+		word, tail, err := readWord(rest)
+		name, value, ok := splitAssignment(word)
+		if err != nil || !ok || !strings.HasPrefix(tail, ";") {
+			return rest
+		}
+		export := "; export " + name + ";"
+		if !strings.HasPrefix(tail, export) {
+			return rest
+		}
+		env[name] = value
+		command = tail[len(export):]
+	}
+}
+
+func splitAssignment(word string) (string, string, bool) {
+	i := strings.IndexByte(word, '=')
+	if i <= 0 || !envNameRegexp.MatchString(word[:i]) {
+		return "", "", false
+	}
+	return word[:i], word[i+1:], true
+}
+
+// 按 POSIX sh 的规则拆分参数，支持单引号、双引号和反斜杠转义
+func splitWords(s string) ([]string, error) {
+	var words []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return words, nil
+		}
+		word, rest, err := readWord(s)
+		if err != nil {
+			return nil, err
+		}
+		if rest == s {
+			// ; 等操作符作为单独的参数
+			word, rest = s[:1], s[1:]
+		}
+		words = append(words, word)
+		s = rest
+	}
+}
+
+// 读取一个参数，遇到未引用的空白或 ; 结束
+func readWord(s string) (string, string, error) {
+	var b strings.Builder
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == ';':
+			return b.String(), s[i:], nil
+		case c == '\\' && i+1 < len(s):
+			b.WriteByte(s[i+1])
+			i += 2
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return "", "", errors.New("unterminated single quote")
+			}
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 2
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`$"\`+"`", s[i+1]) >= 0 {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return "", "", errors.New("unterminated double quote")
+			}
+			i++
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), "", nil
+}
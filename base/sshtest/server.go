@@ -0,0 +1,555 @@
+// 在回环地址上启动的 SSH/SFTP 服务端，用于离线测试 base 包及依赖它的代码
+package sshtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 处理一条命令，返回退出码
+type Handler func(req *Request) int
+
+// 命令请求
+type Request struct {
+	// 登录用户
+	User string
+	// 去掉 sudo 和环境变量前缀之后的命令
+	Command string
+	// 客户端发送的原始命令
+	RawCommand string
+	// 通过 Setenv 和命令前 export 传递的环境变量
+	Env map[string]string
+	// 客户端申请了 pty，此时 Stderr 与 Stdout 相同
+	Pty bool
+	// 通过 sudo 或 su 执行，RunAs 为目标用户
+	Sudo  bool
+	Su    bool
+	RunAs string
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ctx context.Context
+}
+
+// 会话关闭或收到信号时取消
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+type Config struct {
+	// 用户名 -> 密码，同时用于 keyboard-interactive
+	Users map[string]string
+	// 用户名 -> 允许登录的公钥
+	AuthorizedKeys map[string][]ssh.PublicKey
+	// sudo 密码，为空时 sudo 不需要密码
+	SudoPassword string
+	// su 的目标用户 -> 密码，没有配置的用户不存在，以 root 登录时不需要密码
+	SuPasswords map[string]string
+	// 拒绝所有 env 请求，用于测试 export 前缀
+	RejectEnv bool
+	// SFTP 根目录，为空时创建临时目录并在 Close 时删除
+	Root string
+	// 没有匹配的脚本命令时调用，为空时返回 127
+	Handler Handler
+	// 主机私钥，为空时生成 ed25519 密钥
+	HostKey ssh.Signer
+	// 其它类型的主机私钥，用于测试服务端有多种主机公钥的情况
+	ExtraHostKeys []ssh.Signer
+}
+
+type Server struct {
+	// 监听地址，固定为 127.0.0.1
+	Addr string
+	Port int
+	// 主机公钥，用于测试 known_hosts 和指纹校验
+	HostKey ssh.PublicKey
+	// SFTP 根目录在本地的路径
+	Root string
+
+	config    *Config
+	sshConfig *ssh.ServerConfig
+	listener  net.Listener
+	ownRoot   bool
+	mutex     sync.Mutex
+	handlers  map[string]Handler
+	commands  []string
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// 测试用密钥对
+type Key struct {
+	Signer ssh.Signer
+	// OpenSSH 格式的 PEM 私钥，可直接作为 Host.PrivateKey
+	PEM string
+}
+
+func NewKey() (*Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(private, "sshtest")
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Signer: signer, PEM: string(pem.EncodeToMemory(block))}, nil
+}
+
+func (k *Key) PublicKey() ssh.PublicKey {
+	return k.Signer.PublicKey()
+}
+
+// 启动服务端，监听 127.0.0.1 的随机端口
+func NewServer(cfg *Config) (*Server, error) {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	s := &Server{
+		config:   cfg,
+		Root:     cfg.Root,
+		handlers: make(map[string]Handler),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	hostKey := cfg.HostKey
+	if hostKey == nil {
+		key, err := NewKey()
+		if err != nil {
+			return nil, err
+		}
+		hostKey = key.Signer
+	}
+	s.HostKey = hostKey.PublicKey()
+
+	s.sshConfig = &ssh.ServerConfig{
+		PasswordCallback:            s.checkPassword,
+		PublicKeyCallback:           s.checkPublicKey,
+		KeyboardInteractiveCallback: s.checkKeyboardInteractive,
+	}
+	s.sshConfig.AddHostKey(hostKey)
+	for _, key := range cfg.ExtraHostKeys {
+		s.sshConfig.AddHostKey(key)
+	}
+
+	if s.Root == "" {
+		root, err := ioutil.TempDir("", "sshtest-")
+		if err != nil {
+			return nil, err
+		}
+		s.Root = root
+		s.ownRoot = true
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.removeRoot()
+		return nil, err
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.Port = listener.Addr().(*net.TCPAddr).Port
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// 注册命令的处理函数，命令需要完全匹配(去掉 sudo 和环境变量前缀之后)
+func (s *Server) Handle(command string, handler Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[command] = handler
+}
+
+// 注册固定输出的命令
+func (s *Server) Respond(command string, stdout string, exitCode int) {
+	s.Handle(command, func(req *Request) int {
+		_, _ = io.WriteString(req.Stdout, stdout)
+		return exitCode
+	})
+}
+
+// 已执行的命令，按执行顺序
+func (s *Server) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// 远程路径在本地的实际路径
+func (s *Server) Path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// 停止监听，断开所有连接，删除临时根目录
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	s.removeRoot()
+	return err
+}
+
+func (s *Server) removeRoot() {
+	if s.ownRoot {
+		_ = os.RemoveAll(s.Root)
+	}
+}
+
+func (s *Server) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	expected, ok := s.config.Users[conn.User()]
+	if ok && expected == string(password) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("password rejected for %s", conn.User())
+}
+
+func (s *Server) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	for _, k := range s.config.AuthorizedKeys[conn.User()] {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+func (s *Server) checkKeyboardInteractive(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, errors.New("unexpected number of answers")
+	}
+	return s.checkPassword(conn, []byte(answers[0]))
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	// keepalive@openssh.com 等全局请求一律回复失败，与 OpenSSH 一致
+	go ssh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.handleSession(serverConn.User(), channel, requests)
+			}()
+		case "direct-tcpip":
+			wg.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer wg.Done()
+				handleDirectTCPIP(newChannel)
+			}(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+	wg.Wait()
+}
+
+// 客户端 Dial 时的 direct-tcpip 请求，用于测试跳板机和本地转发
+func handleDirectTCPIP(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	// 与 sshd 一致，一端读到 EOF 后只关闭另一端的写方向
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(channel, target)
+		_ = channel.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, channel)
+		_ = target.(*net.TCPConn).CloseWrite()
+	}()
+	wg.Wait()
+}
+
+type session struct {
+	server  *Server
+	user    string
+	channel ssh.Channel
+	env     map[string]string
+	pty     bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mutex   sync.Mutex
+	signal  string
+}
+
+func (s *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		server:  s,
+		user:    user,
+		channel: channel,
+		env:     make(map[string]string),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	defer cancel()
+	defer channel.Close()
+
+	started := false
+	for req := range requests {
+		ok := false
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			if !s.config.RejectEnv && ssh.Unmarshal(req.Payload, &kv) == nil {
+				sess.env[kv.Name] = kv.Value
+				ok = true
+			}
+		case "pty-req":
+			sess.pty = true
+			ok = true
+		case "window-change":
+			ok = true
+		case "signal":
+			var sig struct{ Signal string }
+			if ssh.Unmarshal(req.Payload, &sig) == nil {
+				sess.mutex.Lock()
+				sess.signal = sig.Signal
+				sess.mutex.Unlock()
+				cancel()
+				ok = true
+			}
+		case "exec":
+			var command struct{ Command string }
+			if !started && ssh.Unmarshal(req.Payload, &command) == nil {
+				started, ok = true, true
+				go func() { sess.exit(sess.exec(command.Command, channel)) }()
+			}
+		case "shell":
+			if !started {
+				started, ok = true, true
+				go func() { sess.exit(sess.shell()) }()
+			}
+		case "subsystem":
+			var subsystem struct{ Name string }
+			if !started && ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp" {
+				started, ok = true, true
+				go func() { sess.exit(sess.sftp()) }()
+			}
+		}
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+	}
+}
+
+func (sess *session) exit(code int) {
+	_ = sess.channel.CloseWrite()
+	sess.mutex.Lock()
+	signal := sess.signal
+	sess.mutex.Unlock()
+	if signal != "" {
+		_, _ = sess.channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{Signal: signal}))
+	} else {
+		_, _ = sess.channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+	}
+	sess.channel.Close()
+}
+
+func (sess *session) exec(command string, stdin io.Reader) int {
+	var stdout, stderr io.Writer = sess.channel, sess.channel.Stderr()
+	if sess.pty {
+		// pty 会合并 stderr 并把换行转换为 \r\n
+		stdout = &crlfWriter{w: sess.channel}
+		stderr = stdout
+	}
+	env := make(map[string]string, len(sess.env))
+	for k, v := range sess.env {
+		env[k] = v
+	}
+	return sess.server.dispatch(&Request{
+		User:       sess.user,
+		Command:    command,
+		RawCommand: command,
+		Env:        env,
+		Pty:        sess.pty,
+		Stdin:      stdin,
+		Stdout:     stdout,
+		Stderr:     stderr,
+		ctx:        sess.ctx,
+	})
+}
+
+const shellPrompt = "$ "
+
+// 交互式 shell，逐行执行命令，exit 结束
+func (sess *session) shell() int {
+	reader := bufio.NewReader(sess.channel)
+	code := 0
+	for {
+		_, _ = io.WriteString(sess.channel, shellPrompt)
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line == "exit" || (err != nil && line == "") {
+			return code
+		}
+		if line != "" {
+			code = sess.exec(line, reader)
+		}
+		if err != nil {
+			return code
+		}
+	}
+}
+
+func (sess *session) sftp() int {
+	server := sftp.NewRequestServer(sess.channel, rootHandlers(sess.server.Root))
+	err := server.Serve()
+	server.Close()
+	if err != nil && err != io.EOF {
+		return 1
+	}
+	return 0
+}
+
+func (s *Server) dispatch(req *Request) int {
+	req.Command = stripEnvPrefix(req.Command, req.Env)
+	if words, err := splitWords(req.Command); err == nil && len(words) > 0 {
+		switch words[0] {
+		case "sudo":
+			return s.sudo(req, words)
+		case "su":
+			return s.su(req, words)
+		}
+		// LC_ALL=C su ... 形式的临时变量
+		if args, env := stripAssignments(words); len(args) > 0 && args[0] == "su" {
+			for k, v := range env {
+				req.Env[k] = v
+			}
+			return s.su(req, args)
+		}
+	}
+
+	s.mutex.Lock()
+	s.commands = append(s.commands, req.Command)
+	handler, ok := s.handlers[req.Command]
+	s.mutex.Unlock()
+	if !ok {
+		handler = s.config.Handler
+	}
+	if handler == nil {
+		fmt.Fprintf(req.Stderr, "sh: %s: command not found\n", req.Command)
+		return 127
+	}
+	return handler(req)
+}
+
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(b []byte) (int, error) {
+	_, err := c.w.Write(bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,199 @@
+package sshtest
+
+import (
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 以 root 为根目录的 SFTP 文件系统，客户端看到的绝对路径都映射到 root 下
+type rootFS struct {
+	root string
+}
+
+func rootHandlers(root string) sftp.Handlers {
+	fs := &rootFS{root: root}
+	return sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+}
+
+func (fs *rootFS) local(name string) string {
+	return filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// 错误信息中使用客户端的路径，不暴露本地目录
+func (fs *rootFS) pathError(err error, name string) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return &os.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return &os.PathError{Op: linkErr.Op, Path: name, Err: linkErr.Err}
+	}
+	return err
+}
+
+func (fs *rootFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := os.Open(fs.local(r.Filepath))
+	if err != nil {
+		return nil, fs.pathError(err, r.Filepath)
+	}
+	return f, nil
+}
+
+func (fs *rootFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.openFile(r, os.O_WRONLY)
+}
+
+func (fs *rootFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.openFile(r, os.O_RDWR)
+}
+
+// 写入使用 WriteAt，忽略 Append 标志
+func (fs *rootFS) openFile(r *sftp.Request, flag int) (*os.File, error) {
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	perm := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perm = r.Attributes().FileMode().Perm()
+	}
+	f, err := os.OpenFile(fs.local(r.Filepath), flag, perm)
+	if err != nil {
+		return nil, fs.pathError(err, r.Filepath)
+	}
+	return f, nil
+}
+
+func (fs *rootFS) Filecmd(r *sftp.Request) error {
+	name := fs.local(r.Filepath)
+	var err error
+	switch r.Method {
+	case "Setstat":
+		err = fs.setstat(r, name)
+	case "Rename":
+		// SFTP v3 的 rename 不覆盖已有文件，与 OpenSSH 一致
+		if _, statErr := os.Lstat(fs.local(r.Target)); statErr == nil {
+			return &os.PathError{Op: "rename", Path: r.Target, Err: os.ErrExist}
+		}
+		err = os.Rename(name, fs.local(r.Target))
+	case "Rmdir":
+		err = os.Remove(name)
+	case "Remove":
+		var info os.FileInfo
+		if info, err = os.Lstat(name); err == nil && info.IsDir() {
+			return &os.PathError{Op: "remove", Path: r.Filepath, Err: os.ErrInvalid}
+		}
+		err = os.Remove(name)
+	case "Mkdir":
+		err = os.Mkdir(name, 0755)
+	case "Link":
+		err = os.Link(name, fs.local(r.Target))
+	case "Symlink":
+		// Filepath 为链接内容，Target 为链接文件，绝对路径的链接指向根目录内
+		target := r.Filepath
+		if path.IsAbs(target) {
+			target = fs.local(target)
+		}
+		return fs.pathError(os.Symlink(target, fs.local(r.Target)), r.Target)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return fs.pathError(err, r.Filepath)
+}
+
+// 服务端为覆盖写入的 rename
+func (fs *rootFS) PosixRename(r *sftp.Request) error {
+	return fs.pathError(os.Rename(fs.local(r.Filepath), fs.local(r.Target)), r.Filepath)
+}
+
+func (fs *rootFS) setstat(r *sftp.Request, name string) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(name, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := os.Chmod(name, attrs.FileMode()&os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := os.Chown(name, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *rootFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := fs.local(r.Filepath)
+	switch r.Method {
+	case "List":
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, fs.pathError(err, r.Filepath)
+		}
+		defer f.Close()
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, fs.pathError(err, r.Filepath)
+		}
+		return listerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, fs.pathError(err, r.Filepath)
+		}
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (fs *rootFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := os.Lstat(fs.local(r.Filepath))
+	if err != nil {
+		return nil, fs.pathError(err, r.Filepath)
+	}
+	return listerAt{info}, nil
+}
+
+// 指向根目录内的绝对路径链接去掉根目录前缀
+func (fs *rootFS) Readlink(name string) (string, error) {
+	target, err := os.Readlink(fs.local(name))
+	if err != nil {
+		return "", fs.pathError(err, name)
+	}
+	if rel, err := filepath.Rel(fs.root, target); err == nil && filepath.IsAbs(target) && !strings.HasPrefix(rel, "..") {
+		return "/" + filepath.ToSlash(rel), nil
+	}
+	return target, nil
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,319 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 提权方式
+type EscalateMethod string
+
+const (
+	// sudo -S，密码从 stdin 输入
+	SudoEscalate EscalateMethod = "sudo"
+	// su - 切换到目标用户，需要 pty
+	SuEscalate EscalateMethod = "su"
+)
+
+var (
+	// 提权密码错误
+	ErrEscalationAuth = errors.New("privilege escalation: authentication failed")
+	// 需要密码但没有配置
+	ErrEscalationPasswordRequired = errors.New("privilege escalation: password is required")
+)
+
+// 提权选项
+type EscalateOptions struct {
+	// 为空时默认 sudo
+	Method EscalateMethod
+	// 目标用户，为空时为 root
+	User string
+	// 提权密码，sudo 为空时使用 Host.Password，su 为目标用户的密码
+	Password string
+	// sudo 时申请 pty，用于配置了 requiretty 的主机，stderr 会合并到 stdout
+	Pty bool
+}
+
+// su 输出的密码提示，统一用 LC_ALL=C 执行 su 保证提示为英文
+var suPromptRegexp = regexp.MustCompile(`(?i)password:\s*$`)
+
+// su 密码错误时提示之后的第一行输出，依次为 Linux、Solaris/HP-UX 和 AIX
+var suFailureRegexp = regexp.MustCompile(`(?i)^\s*(su: (authentication failure|incorrect password|sorry)|\S+ you entered an invalid login name or password)`)
+
+func (o *EscalateOptions) password(h *Host) string {
+	if o.Password != "" {
+		return o.Password
+	}
+	return h.Password
+}
+
+// 以其它用户身份执行命令
+func RunAsCmdContext(ctx context.Context, h *Host, cfg ssh.Config, cmd string, opts *EscalateOptions, envs ...EnvMap) (*CommandResult, error) {
+	conn, release, err := openSSHClient(ctx, h, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return escalateCommand(ctx, conn, h, cmd, opts, envs...)
+}
+
+// 判断当前用户是否可以免密 sudo
+func SudoPasswordless(ctx context.Context, h *Host, cfg ssh.Config) (bool, error) {
+	_, err := RunCmdResultContext(ctx, h, cfg, "sudo -n true")
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 与旧版本一致使用 pty，兼容配置了 requiretty 的主机
+func sudoCommand(ctx context.Context, client *ssh.Client, h *Host, command string, envs ...EnvMap) (*CommandResult, error) {
+	return escalateCommand(ctx, client, h, command, &EscalateOptions{Method: SudoEscalate, Pty: true}, envs...)
+}
+
+func escalateCommand(ctx context.Context, client *ssh.Client, h *Host, command string, opts *EscalateOptions, envs ...EnvMap) (result *CommandResult, err error) {
+	if opts == nil {
+		opts = &EscalateOptions{}
+	}
+	password := opts.password(h)
+
+	start := time.Now()
+	defer func() {
+		action, runAs := AuditSudo, opts.User
+		if opts.Method == SuEscalate {
+			action = AuditSu
+		}
+		if runAs == "" {
+			runAs = "root"
+		}
+		var bytes int64
+		if result != nil {
+			bytes = int64(len(result.Stdout) + len(result.Stderr))
+		}
+		auditCommand(h, action, runAs, command, start, result, bytes, err, password)
+	}()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// sudo 和 su - 会重置环境变量，统一在提权后的命令前 export
+	vars, err := flattenEnv(envs)
+	if err != nil {
+		return nil, err
+	}
+	target := envPrefix(h.Platform, vars) + command
+
+	in, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		outputBuf bytes.Buffer
+		errorBuf  bytes.Buffer
+		watcher   *promptWatcher
+		remote    string
+		usePty    bool
+	)
+
+	switch opts.Method {
+	case "", SudoEscalate:
+		marker, err := promptMarker()
+		if err != nil {
+			return nil, err
+		}
+		args := []string{"sudo"}
+		if password == "" {
+			// 没有密码时不等待输入，需要密码则直接失败
+			args = append(args, "-n")
+		} else {
+			args = append(args, "-S", "-p", marker)
+		}
+		if opts.User != "" {
+			args = append(args, "-u", opts.User)
+		}
+		remote = shellJoin(args...) + " -- sh -c " + shellQuote(target)
+		usePty = opts.Pty
+		if usePty {
+			watcher = newPromptWatcher(&outputBuf, func(tail []byte) bool {
+				return bytes.HasSuffix(tail, []byte(marker))
+			}, marker)
+			session.Stdout = watcher
+			session.Stderr = &errorBuf
+		} else {
+			watcher = newPromptWatcher(&errorBuf, func(tail []byte) bool {
+				return bytes.HasSuffix(tail, []byte(marker))
+			}, marker)
+			session.Stdout = &outputBuf
+			session.Stderr = watcher
+		}
+	case SuEscalate:
+		if password == "" {
+			return nil, ErrEscalationPasswordRequired
+		}
+		user := opts.User
+		if user == "" {
+			user = "root"
+		}
+		remote = "LC_ALL=C su - " + shellQuote(user) + " -c " + shellQuote(target)
+		watcher = newPromptWatcher(&outputBuf, suPromptRegexp.Match, "")
+		// su 的提示只会出现在第一行，之后是命令的输出，不再检查避免误判
+		watcher.firstLine = true
+		session.Stdout = watcher
+		session.Stderr = &errorBuf
+		usePty = true
+	default:
+		return nil, fmt.Errorf("unsupported escalate method: %s", opts.Method)
+	}
+
+	watcher.onPrompt = func(times int) {
+		if times > 1 {
+			// 再次出现提示说明密码错误，关闭 stdin 让远程命令退出
+			in.Close()
+			return
+		}
+		_, _ = io.WriteString(in, password+"\n")
+	}
+
+	if usePty {
+		err = requestPty(session, defaultTerm, 80, 40)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result = &CommandResult{Host: hostName(h), Command: command}
+	start = time.Now()
+	err = session.Start(remote)
+	if err != nil {
+		return nil, err
+	}
+	err = waitSession(ctx, session)
+	result.Duration = time.Since(start)
+
+	stdout, stderr := outputBuf.String(), errorBuf.String()
+	if usePty {
+		// 去掉密码提示及之前的输出，pty 会把换行转换为 \r\n
+		// 只去掉读取密码后回显的换行，命令输出开头的空行保留
+		if end := watcher.promptEnd(); end > 0 {
+			stdout = trimLineEnding(stdout[end:])
+		}
+		stdout = strings.Replace(stdout, "\r\n", "\n", -1)
+	}
+	result.Stdout = redact(stdout, password, watcher.marker)
+	result.Stderr = redact(stderr, password, watcher.marker)
+
+	if ctx.Err() != nil {
+		result.ExitCode = -1
+		return result, ctx.Err()
+	}
+	err = commandError(result, err)
+	if err != nil && watcher.prompts() > 1 {
+		return result, ErrEscalationAuth
+	}
+	// su 密码错误时直接退出，不会再次提示
+	if err != nil && opts.Method == SuEscalate && watcher.prompts() == 1 && suFailureRegexp.MatchString(stdout) {
+		return result, ErrEscalationAuth
+	}
+	return result, err
+}
+
+func trimLineEnding(s string) string {
+	if strings.HasPrefix(s, "\r\n") {
+		return s[2:]
+	}
+	return strings.TrimPrefix(s, "\n")
+}
+
+func promptMarker() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "[base-sudo-" + hex.EncodeToString(b) + "]", nil
+}
+
+// 从输出中去掉密码和提示标记
+func redact(s string, password string, marker string) string {
+	if marker != "" {
+		s = strings.Replace(s, marker, "", -1)
+	}
+	if password != "" {
+		s = strings.Replace(s, password, "******", -1)
+	}
+	return s
+}
+
+// 在 session 写入输出时同步检查密码提示，不需要额外的协程轮询
+type promptWatcher struct {
+	mutex    sync.Mutex
+	w        io.Writer
+	match    func(tail []byte) bool
+	marker   string
+	onPrompt func(times int)
+	// 只在第一行输出中检查一次提示
+	firstLine bool
+	done      bool
+	tail      []byte
+	times     int
+	written   int
+	end       int
+}
+
+const promptTailSize = 256
+
+func newPromptWatcher(w io.Writer, match func(tail []byte) bool, marker string) *promptWatcher {
+	return &promptWatcher{w: w, match: match, marker: marker}
+}
+
+func (p *promptWatcher) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n, err := p.w.Write(b)
+	p.written += n
+	p.tail = append(p.tail, b...)
+	if len(p.tail) > promptTailSize {
+		p.tail = p.tail[len(p.tail)-promptTailSize:]
+	}
+	if !p.done && p.match(p.tail) {
+		p.tail = p.tail[:0]
+		p.times++
+		p.end = p.written
+		p.done = p.firstLine
+		if p.onPrompt != nil {
+			p.onPrompt(p.times)
+		}
+	} else if p.firstLine && bytes.IndexByte(b, '\n') >= 0 {
+		// 第一行不是提示说明不需要密码
+		p.done = true
+	}
+	return n, err
+}
+
+func (p *promptWatcher) prompts() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.times
+}
+
+// 最后一次提示在输出中的结束位置
+func (p *promptWatcher) promptEnd() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.end
+}
@@ -0,0 +1,79 @@
+package base
+
+import (
+	"context"
+	"errors"
+	"infra/base/sshtest"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 输出执行命令的用户，开头的空行用来检查提示之后的输出是否完整
+func whoamiHandler(req *sshtest.Request) int {
+	user := req.User
+	if req.Sudo || req.Su {
+		user = req.RunAs
+	}
+	_, _ = req.Stdout.Write([]byte("\n" + user + "\n"))
+	return 0
+}
+
+func TestRunSudoCmd(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{SudoPassword: "secret"})
+	s.Handle("whoami", whoamiHandler)
+
+	out, err := RunSudoCmd(h, ssh.Config{}, "whoami")
+	if err != nil || out != "\nroot\n" {
+		t.Fatalf("RunSudoCmd = %q, %v", out, err)
+	}
+
+	for _, pty := range []bool{false, true} {
+		result, err := RunAsCmdContext(context.Background(), h, ssh.Config{}, "whoami",
+			&EscalateOptions{User: "bob", Pty: pty})
+		if err != nil || result.Stdout != "\nbob\n" {
+			t.Fatalf("pty %v: RunAsCmdContext = %+v, %v", pty, result, err)
+		}
+	}
+}
+
+func TestRunSudoCmdWrongPassword(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{SudoPassword: "root-pw"})
+	s.Handle("whoami", whoamiHandler)
+
+	for _, pty := range []bool{false, true} {
+		result, err := RunAsCmdContext(context.Background(), h, ssh.Config{}, "whoami",
+			&EscalateOptions{Password: "wrong", Pty: pty})
+		if !errors.Is(err, ErrEscalationAuth) {
+			t.Fatalf("pty %v: error = %v, want ErrEscalationAuth", pty, err)
+		}
+		if result == nil || result.ExitCode == 0 {
+			t.Fatalf("pty %v: result = %+v", pty, result)
+		}
+	}
+}
+
+func TestRunAsCmdSu(t *testing.T) {
+	s, h := newTestServer(t, &sshtest.Config{SuPasswords: map[string]string{"root": "root-pw", "bob": "bob-pw"}})
+	s.Handle("whoami", whoamiHandler)
+
+	for _, opts := range []*EscalateOptions{
+		{Method: SuEscalate, Password: "root-pw"},
+		{Method: SuEscalate, User: "bob", Password: "bob-pw"},
+	} {
+		want := "\n" + opts.User + "\n"
+		if opts.User == "" {
+			want = "\nroot\n"
+		}
+		result, err := RunAsCmdContext(context.Background(), h, ssh.Config{}, "whoami", opts)
+		if err != nil || result.Stdout != want {
+			t.Fatalf("su %s: RunAsCmdContext = %+v, %v", opts.User, result, err)
+		}
+	}
+
+	_, err := RunAsCmdContext(context.Background(), h, ssh.Config{}, "whoami",
+		&EscalateOptions{Method: SuEscalate, Password: "wrong"})
+	if !errors.Is(err, ErrEscalationAuth) {
+		t.Fatalf("error = %v, want ErrEscalationAuth", err)
+	}
+}